@@ -1,9 +1,13 @@
 package speedtest
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dchest/uniuri"
@@ -16,6 +20,8 @@ var (
 	DefaultDLSizes = []int{350, 500, 750, 1000, 1500, 2000, 2500, 3000, 3500, 4000}
 	// DefaultULSizes defines the default upload sizes
 	DefaultULSizes = []int{int(0.25 * 1024 * 1024), int(0.5 * 1024 * 1024), int(1.0 * 1024 * 1024), int(1.5 * 1024 * 1024), int(2.0 * 1024 * 1024)}
+	// DefaultTestLength is how long a time bounded test runs when the config has no testlength
+	DefaultTestLength = 10 * time.Second
 )
 
 const max = "max"
@@ -25,20 +31,64 @@ type Client struct {
 	HTTPClient *http.Client
 	DLSizes    []int
 	ULSizes    []int
+
+	// TimeBounded makes Download and Upload keep cycling through their
+	// sizes until the config's testlength elapses instead of stopping
+	// after a single pass
+	TimeBounded bool
+
+	// Progress, when set, is called every ProgressInterval while Download
+	// and Upload run, and once more when they finish
+	Progress         func(Progress)
+	ProgressInterval time.Duration
+
+	// Logger receives debug events for each phase of a test, falling back
+	// to HTTPClient's Logger when nil
+	Logger Logger
+
+	// Failover makes Download and Upload move on to the next of the
+	// Candidates when the server they test against fails
+	Failover bool
+
+	mu         sync.Mutex
+	candidates []http.Server
+}
+
+// Logger receives structured log events, see http.Logger
+type Logger = http.Logger
+
+// logger returns the Logger events are sent to
+func (client *Client) logger() Logger {
+	if client.Logger != nil {
+		return client.Logger
+	}
+	if client.HTTPClient != nil && client.HTTPClient.Logger != nil {
+		return client.HTTPClient.Logger
+	}
+	return http.NopLogger
 }
 
-// Config define Speedtest settings
+// Config define Speedtest settings, the subset of http.SpeedtestConfig most
+// callers need. NewClientFromConfig creates a client from it.
 type Config struct {
-	ConfigURL       string
-	ServersURL      string
+	ConfigURL  string
+	ServersURL string
+	// ConfigFile and ServersFile load saved config and servers XML in place of ConfigURL and ServersURL
+	ConfigFile      string
+	ServersFile     string
 	AlgoType        string
 	NumClosest      int
 	NumLatencyTests int
-	Interface       string
-	Blacklist       []string
-	UserAgent       string
+	// Interface binds every request to a network interface name or source IP address
+	Interface string
+	UserAgent string
+	// Blacklist lists server IDs to exclude on top of the config's ignoreids
+	Blacklist []string
+	// Allowlist, when not empty, restricts server selection to these server IDs
+	Allowlist []string
 }
 
+// NewClient creates a client, fetching the speedtest.net config described by config
 func NewClient(config *http.SpeedtestConfig, dlsizes []int, ulsizes []int, timeout time.Duration) (*Client, error) {
 	httpClient, err := http.NewClient(config, timeout)
 	if err != nil {
@@ -52,33 +102,90 @@ func NewClient(config *http.SpeedtestConfig, dlsizes []int, ulsizes []int, timeo
 	}, nil
 }
 
-func NewDefaultClient() (*Client, error) {
-	config := &http.SpeedtestConfig{
-		ConfigURL:       "http://c.speedtest.net/speedtest-config.php?x=" + uniuri.New(),
-		ServersURL:      "http://c.speedtest.net/speedtest-servers-static.php?x=" + uniuri.New(),
-		AlgoType:        "max",
-		NumClosest:      3,
-		NumLatencyTests: 3,
-		UserAgent:       "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_12_0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/55.0.2883.21 Safari/537.36",
+// SpeedtestConfig returns the http.SpeedtestConfig holding config's settings
+func (config *Config) SpeedtestConfig() *http.SpeedtestConfig {
+	return &http.SpeedtestConfig{
+		ConfigURL:       config.ConfigURL,
+		ServersURL:      config.ServersURL,
+		ConfigFile:      config.ConfigFile,
+		ServersFile:     config.ServersFile,
+		AlgoType:        config.AlgoType,
+		NumClosest:      config.NumClosest,
+		NumLatencyTests: config.NumLatencyTests,
+		Interface:       config.Interface,
+		UserAgent:       config.UserAgent,
+		Blacklist:       config.Blacklist,
+		Allowlist:       config.Allowlist,
 	}
+}
+
+// NewClientFromConfig creates a client with the settings in config
+func NewClientFromConfig(config *Config, dlsizes []int, ulsizes []int, timeout time.Duration) (*Client, error) {
+	return NewClient(config.SpeedtestConfig(), dlsizes, ulsizes, timeout)
+}
 
-	httpClient, err := http.NewClient(config, 30*time.Second)
+// NewClientFromReaders creates a client from config and servers XML in the
+// speedtest-config.php and speedtest-servers-static.php formats, for testing
+// without reaching speedtest.net
+func NewClientFromReaders(config *http.SpeedtestConfig, configXML io.Reader, serversXML io.Reader, dlsizes []int, ulsizes []int, timeout time.Duration) (*Client, error) {
+	httpClient, err := http.NewClientFromReaders(config, configXML, serversXML, timeout)
 	if err != nil {
 		return &Client{}, err
 	}
 
 	return &Client{
 		HTTPClient: httpClient,
-		DLSizes:    DefaultDLSizes,
-		ULSizes:    DefaultULSizes,
+		DLSizes:    dlsizes,
+		ULSizes:    ulsizes,
 	}, nil
 }
 
+// NewDefaultConfig returns the settings NewDefaultClient tests against speedtest.net with
+func NewDefaultConfig() *http.SpeedtestConfig {
+	return &http.SpeedtestConfig{
+		ConfigURL:       "http://c.speedtest.net/speedtest-config.php?x=" + uniuri.New(),
+		ServersURL:      "http://c.speedtest.net/speedtest-servers-static.php?x=" + uniuri.New(),
+		AlgoType:        "max",
+		NumClosest:      3,
+		NumLatencyTests: 3,
+		UserAgent:       "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_12_0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/55.0.2883.21 Safari/537.36",
+	}
+}
+
+// NewDefaultClient creates a client using NewDefaultConfig, the default sizes and a 30 second timeout
+func NewDefaultClient() (*Client, error) {
+	return NewClient(NewDefaultConfig(), DefaultDLSizes, DefaultULSizes, 30*time.Second)
+}
+
 // Download will perform the "normal" speedtest download test
 func (client *Client) Download(server http.Server) (float64, error) {
-	var urls []string
-	var maxSpeed float64
-	var avgSpeed float64
+	return client.DownloadContext(context.Background(), server)
+}
+
+// DownloadContext performs the download test, returning ctx.Err() as soon as ctx is done.
+// With Failover set, a failing server is replaced by the next of the Candidates.
+// When the config advertises a threadcount above one, each URL is fetched
+// threadsperurl times across that many concurrent connections.
+func (client *Client) DownloadContext(ctx context.Context, server http.Server) (float64, error) {
+	t, threads, err := client.download(ctx, server)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.speed(threads, client.HTTPClient.SpeedtestConfig.AlgoType), nil
+}
+
+// download runs the download test, failing over when enabled, and returns
+// the raw transfer along with the number of connections it used
+func (client *Client) download(ctx context.Context, server http.Server) (transfer, int, error) {
+	return client.withFailover(ctx, PhaseDownload, server, client.downloadFrom)
+}
+
+// downloadFrom runs the download test against server
+func (client *Client) downloadFrom(ctx context.Context, server http.Server) (transfer, int, error) {
+	var jobs []job
+
+	threads, threadsPerURL := client.downloadThreads()
 
 	// http://speedtest1.newbreakcommunications.net/speedtest/speedtest/
 	for size := range client.DLSizes {
@@ -89,100 +196,296 @@ func (client *Client) Download(server http.Server) (float64, error) {
 
 		randomImage := fmt.Sprintf("random%dx%d.jpg", client.DLSizes[size], client.DLSizes[size])
 		downloadURL := "http:/" + baseURL + "/" + randomImage
-		urls = append(urls, downloadURL)
+		for i := 0; i < threadsPerURL; i++ {
+			jobs = append(jobs, func(ctx context.Context, m *meter) (int64, error) {
+				return client.HTTPClient.DownloadContext(ctx, downloadURL, m)
+			})
+		}
 	}
 
-	for u := range urls {
-		dlSpeed, err := client.HTTPClient.DownloadSpeed(urls[u])
-		if err != nil {
-			return 0, err
-		}
+	opts := client.transferOptions(PhaseDownload, threads, client.downloadTestLength())
+	client.logger().Debug("starting download test", "server", server.ID, "requests", len(jobs), "threads", threads, "length", opts.Length)
+	t, err := runTransfer(ctx, jobs, opts)
+	client.logTransfer(PhaseDownload, t, err)
+	return t, threads, err
+}
 
-		if client.HTTPClient.SpeedtestConfig.AlgoType == max {
-			if dlSpeed > maxSpeed {
-				maxSpeed = dlSpeed
-			}
-		} else {
-			avgSpeed = avgSpeed + dlSpeed
-		}
+// downloadThreads returns the number of concurrent connections and
+// requests per URL the download test should use
+func (client *Client) downloadThreads() (threads int, threadsPerURL int) {
+	config := client.HTTPClient.Config
+	if config == nil || config.ThreadCount <= 1 {
+		return 1, 1
 	}
 
-	if client.HTTPClient.SpeedtestConfig.AlgoType != max {
-		return avgSpeed / float64(len(urls)), nil
+	threadsPerURL = config.DownloadThreadsPerURL
+	if threadsPerURL < 1 {
+		threadsPerURL = 1
 	}
-	return maxSpeed, nil
-
+	return config.ThreadCount, threadsPerURL
 }
 
 // Upload runs a "normal" speedtest upload test
 func (client *Client) Upload(server http.Server) (float64, error) {
-	// https://github.com/sivel/speedtest-cli/blob/master/speedtest-cli
-	var ulsize []int
-	var maxSpeed float64
-	var avgSpeed float64
+	return client.UploadContext(context.Background(), server)
+}
 
-	for size := range client.ULSizes {
-		ulsize = append(ulsize, client.ULSizes[size])
+// UploadContext runs the upload test, returning ctx.Err() as soon as ctx is done.
+// With Failover set, a failing server is replaced by the next of the Candidates.
+// When the config advertises more than one upload thread, the upload
+// ratio, maxchunksize and maxchunkcount settings shape the payloads which
+// are then posted across that many concurrent connections.
+func (client *Client) UploadContext(ctx context.Context, server http.Server) (float64, error) {
+	t, threads, err := client.upload(ctx, server)
+	if err != nil {
+		return 0, err
 	}
 
+	return t.speed(threads, client.HTTPClient.SpeedtestConfig.AlgoType), nil
+}
+
+// upload runs the upload test, failing over when enabled, and returns the
+// raw transfer along with the number of connections it used
+func (client *Client) upload(ctx context.Context, server http.Server) (transfer, int, error) {
+	return client.withFailover(ctx, PhaseUpload, server, client.uploadFrom)
+}
+
+// uploadFrom runs the upload test against server
+func (client *Client) uploadFrom(ctx context.Context, server http.Server) (transfer, int, error) {
+	// https://github.com/sivel/speedtest-cli/blob/master/speedtest-cli
+	var jobs []job
+
+	threads, ulsize := client.uploadSizes()
+	payloads := make(map[int][]byte)
+
 	for i := 0; i < len(ulsize); i++ {
-		r := util.Urandom(ulsize[i])
-		ulSpeed, err := client.HTTPClient.UploadSpeed(server.URL, "text/xml", r)
-		if err != nil {
-			return 0, err
+		if _, ok := payloads[ulsize[i]]; !ok {
+			payloads[ulsize[i]] = util.Urandom(ulsize[i])
 		}
 
-		if client.HTTPClient.SpeedtestConfig.AlgoType == max {
-			if ulSpeed > maxSpeed {
-				maxSpeed = ulSpeed
-			}
-		} else {
-			avgSpeed = avgSpeed + ulSpeed
+		r := payloads[ulsize[i]]
+		jobs = append(jobs, func(ctx context.Context, m *meter) (int64, error) {
+			return client.HTTPClient.UploadContext(ctx, server.URL, "text/xml", bytes.NewReader(r), m)
+		})
+	}
+
+	opts := client.transferOptions(PhaseUpload, threads, client.uploadTestLength())
+	client.logger().Debug("starting upload test", "server", server.ID, "requests", len(jobs), "threads", threads, "length", opts.Length)
+	t, err := runTransfer(ctx, jobs, opts)
+	client.logTransfer(PhaseUpload, t, err)
+	return t, threads, err
+}
+
+// logTransfer logs the outcome of the phase test
+func (client *Client) logTransfer(phase string, t transfer, err error) {
+	if err != nil {
+		client.logger().Debug("test failed", "phase", phase, "bytes", t.Bytes, "elapsed", t.Elapsed, "error", err)
+		return
+	}
+	client.logger().Debug("test finished", "phase", phase, "bytes", t.Bytes, "elapsed", t.Elapsed, "requests", len(t.Samples), "mbps", mbps(t.Bytes, t.Elapsed))
+}
+
+// uploadSizes returns the number of concurrent connections and the size of
+// every upload the upload test should perform
+func (client *Client) uploadSizes() (threads int, ulsize []int) {
+	config := client.HTTPClient.Config
+	if config == nil || config.UploadThreads <= 1 || len(client.ULSizes) == 0 {
+		return 1, client.ULSizes
+	}
+
+	sizes := client.ULSizes
+	if config.UploadRatio > 1 {
+		start := config.UploadRatio - 1
+		if start > len(sizes)-1 {
+			start = len(sizes) - 1
+		}
+		sizes = sizes[start:]
+	}
+
+	count := config.UploadMaxChunkCount
+	if count < 1 {
+		count = len(sizes)
+	}
+
+	for i := 0; i < count; i++ {
+		size := sizes[i%len(sizes)]
+		if config.UploadMaxChunkSize > 0 && size > config.UploadMaxChunkSize {
+			size = config.UploadMaxChunkSize
+		}
+		ulsize = append(ulsize, size)
+	}
+
+	return config.UploadThreads, ulsize
+}
+
+// transferOptions builds the options for a test of phase over threads
+// connections whose config advertises a testlength of configured
+func (client *Client) transferOptions(phase string, threads int, configured time.Duration) transferOptions {
+	opts := transferOptions{
+		Threads:  threads,
+		Phase:    phase,
+		Progress: client.Progress,
+		Interval: client.ProgressInterval,
+	}
+
+	if client.TimeBounded {
+		opts.Length = configured
+		if opts.Length <= 0 {
+			opts.Length = DefaultTestLength
 		}
+	}
+
+	return opts
+}
 
+func (client *Client) downloadTestLength() time.Duration {
+	if client.HTTPClient.Config == nil {
+		return 0
 	}
+	return client.HTTPClient.Config.DownloadTestLength
+}
 
-	if client.HTTPClient.SpeedtestConfig.AlgoType != max {
-		return avgSpeed / float64(len(ulsize)), nil
+func (client *Client) uploadTestLength() time.Duration {
+	if client.HTTPClient.Config == nil {
+		return 0
 	}
-	return maxSpeed, nil
+	return client.HTTPClient.Config.UploadTestLength
 }
 
+// GetServer returns the server with serverID, or the fastest of the closest servers when serverID is empty.
+// With an allowlist configured, only the allowlisted servers are candidates.
 func (client *Client) GetServer(serverID string) (http.Server, error) {
-	server := http.Server{}
+	return client.GetServerContext(context.Background(), serverID)
+}
+
+// GetServerContext is GetServer, aborting the server list fetch and latency probes when ctx is done
+func (client *Client) GetServerContext(ctx context.Context, serverID string) (http.Server, error) {
+	ranked, err := client.RankServersContext(ctx, serverID)
+	if err != nil {
+		return http.Server{}, err
+	}
+
+	return ranked[0], nil
+}
+
+// RankServers returns the reachable candidates GetServer chooses from,
+// fastest first: the server with serverID alone, or the allowlisted or
+// closest servers when serverID is empty. They are kept as the Candidates
+// Download and Upload fail over to.
+func (client *Client) RankServers(serverID string) ([]http.Server, error) {
+	return client.RankServersContext(context.Background(), serverID)
+}
 
-	allServers, err := client.HTTPClient.GetServers()
+// RankServersContext ranks the candidates like RankServers, aborting when ctx is done
+func (client *Client) RankServersContext(ctx context.Context, serverID string) ([]http.Server, error) {
+	allServers, err := client.HTTPClient.GetServersContext(ctx)
 	if err != nil {
-		return server, err
+		return nil, err
 	}
 
+	var ranked []http.Server
 	if serverID != "" {
-		server = client.FindServer(serverID, allServers)
-		server.Latency, err = client.HTTPClient.GetLatency(client.HTTPClient.GetLatencyURL(server))
+		if !client.HTTPClient.Allowed(serverID) {
+			return nil, fmt.Errorf("%w: server id '%s'", ErrServerNotAllowed, serverID)
+		}
+		server, err := client.FindServer(serverID, allServers)
+		if err != nil {
+			return nil, err
+		}
+		server, err = client.HTTPClient.MeasureServerContext(ctx, server)
 		if err != nil {
-			return server, err
+			return nil, err
+		}
+		ranked = []http.Server{server}
+	} else if len(client.HTTPClient.SpeedtestConfig.Allowlist) > 0 {
+		ranked, err = client.rankAllowedServers(ctx, allServers)
+		if err != nil {
+			return nil, err
 		}
 	} else {
 		closestServers := client.HTTPClient.GetClosestServers(allServers)
-		server, err = client.HTTPClient.GetFastestServer(closestServers)
+		ranked, err = client.HTTPClient.RankServersContext(ctx, closestServers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client.mu.Lock()
+	client.candidates = ranked
+	client.mu.Unlock()
+
+	server := ranked[0]
+	client.logger().Debug("selected server", "id", server.ID, "sponsor", server.Sponsor, "name", server.Name, "latency_ms", server.Latency, "candidates", len(ranked))
+	return ranked, nil
+}
+
+// Candidates returns the servers ranked by the last GetServer or RankServers call, fastest first
+func (client *Client) Candidates() []http.Server {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return append([]http.Server(nil), client.candidates...)
+}
+
+// rankAllowedServers probes every allowlisted server in allServers and
+// returns the reachable ones, fastest first
+func (client *Client) rankAllowedServers(ctx context.Context, allServers []http.Server) ([]http.Server, error) {
+	var candidates []http.Server
+	var reachable []http.Server
+	var lastErr error
+
+	for _, server := range allServers {
+		if client.HTTPClient.Allowed(server.ID) {
+			candidates = append(candidates, server)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: none of the allowlisted servers %v are in the server list", ErrNoServersAvailable, client.HTTPClient.SpeedtestConfig.Allowlist)
+	}
+
+	for _, server := range candidates {
+		measured, err := client.HTTPClient.MeasureServerContext(ctx, server)
 		if err != nil {
-			return server, err
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			client.logger().Debug("skipping unreachable allowlisted server", "id", server.ID, "error", err)
+			lastErr = err
+			continue
 		}
+
+		reachable = append(reachable, measured)
+	}
+	if len(reachable) == 0 {
+		return nil, fmt.Errorf("%w: none of the allowlisted servers %v are reachable: %v", ErrNoServersAvailable, client.HTTPClient.SpeedtestConfig.Allowlist, lastErr)
 	}
 
-	return server, nil
+	sort.Stable(http.ByLatency(reachable))
+	return reachable, nil
 }
 
-// FindServer will find a specific server in the servers list
-func (client *Client) FindServer(id string, serversList []http.Server) http.Server {
-	var foundServer http.Server
+// ListServers returns the servers matching query, closest first
+func (client *Client) ListServers(query http.ServerQuery) ([]http.Server, error) {
+	return client.ListServersContext(context.Background(), query)
+}
+
+// ListServersContext is ListServers, aborting the server list fetch when ctx is done
+func (client *Client) ListServersContext(ctx context.Context, query http.ServerQuery) ([]http.Server, error) {
+	allServers, err := client.HTTPClient.GetServersContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.HTTPClient.QueryServers(allServers, query), nil
+}
+
+// FindServer will find a specific server in the servers list, returning
+// an error wrapping ErrServerNotFound when it is not there
+func (client *Client) FindServer(id string, serversList []http.Server) (http.Server, error) {
 	for s := range serversList {
 		if serversList[s].ID == id {
-			foundServer = serversList[s]
+			return serversList[s], nil
 		}
 	}
-	if foundServer.ID == "" {
-		log.Printf("cannot locate server id '%s' in our list of speedtest servers", id)
-	}
-	return foundServer
+	return http.Server{}, fmt.Errorf("%w: cannot locate server id '%s' in our list of speedtest servers", ErrServerNotFound, id)
 }
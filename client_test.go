@@ -1,12 +1,18 @@
 package speedtest
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -46,6 +52,92 @@ func TestNewClient(t *testing.T) {
 	}
 }
 
+func TestNewClientFromReaders(t *testing.T) {
+	config, err := os.Open("http/sthttp_test_config.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.Close()
+	servers, err := os.Open("http/sthttp_test_servers.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer servers.Close()
+
+	client, err := NewClientFromReaders(&sthttp.SpeedtestConfig{NumClosest: 3}, config, servers, DefaultDLSizes, DefaultULSizes, 15*time.Second)
+	if err != nil {
+		t.Fatalf("NewClientFromReaders() error = %v", err)
+	}
+
+	got, err := client.ListServersContext(context.Background(), sthttp.ServerQuery{Max: 1})
+	if err != nil {
+		t.Fatalf("Client.ListServersContext() error = %v", err)
+	}
+	if len(got) != 1 || got[0].ID != "2630" {
+		t.Errorf("Client.ListServersContext() = %v, want the closest server 2630", got)
+	}
+}
+
+func TestNewClientFromConfig(t *testing.T) {
+	client, err := NewClientFromConfig(&Config{
+		ConfigFile:  "http/sthttp_test_config.xml",
+		ServersFile: "http/sthttp_test_servers.xml",
+		NumClosest:  3,
+		Blacklist:   []string{"2630"},
+		Allowlist:   []string{"2630", "5280"},
+	}, DefaultDLSizes, DefaultULSizes, 15*time.Second)
+	if err != nil {
+		t.Fatalf("NewClientFromConfig() error = %v", err)
+	}
+
+	if !client.HTTPClient.Allowed("5280") || client.HTTPClient.Allowed("4471") {
+		t.Errorf("Client.HTTPClient.Allowed() ignores the allowlist %v", client.HTTPClient.SpeedtestConfig.Allowlist)
+	}
+
+	got, err := client.ListServers(sthttp.ServerQuery{Max: 1})
+	if err != nil {
+		t.Fatalf("Client.ListServers() error = %v", err)
+	}
+	if len(got) != 1 || got[0].ID == "2630" {
+		t.Errorf("Client.ListServers() = %v, want the closest server other than the blacklisted 2630", got)
+	}
+}
+
+func TestNewDefaultConfig_ServerCache(t *testing.T) {
+	x, err := ioutil.ReadFile("http/sthttp_test_servers.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write(x)
+	}))
+	defer ts.Close()
+
+	cache := sthttp.NewFileCache(t.TempDir() + "/servers.json")
+	for i := 0; i < 2; i++ {
+		// each run builds its config afresh, with a new cache-buster
+		config := NewDefaultConfig()
+		config.ServersURL = strings.Replace(config.ServersURL, "http://c.speedtest.net", ts.URL, 1)
+		config.ConfigFile = "http/sthttp_test_config.xml"
+		config.ServerCache = cache
+
+		client, err := NewClient(config, DefaultDLSizes, DefaultULSizes, 15*time.Second)
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		if servers, err := client.HTTPClient.GetServers(); err != nil || len(servers) == 0 {
+			t.Fatalf("Client.GetServers() = %d servers, %v", len(servers), err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("fetched the server list %d times across two runs, want 1", got)
+	}
+}
+
 func TestClient_Download(t *testing.T) {
 	f, err := os.Open("http/random750x750.jpg")
 	if err != nil {
@@ -215,6 +307,240 @@ func TestClient_Upload(t *testing.T) {
 	}
 }
 
+func TestClient_DownloadParallel(t *testing.T) {
+	var requests, inFlight, peak int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		w.Write(make([]byte, 64*1024))
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		HTTPClient: &sthttp.Client{
+			SpeedtestConfig: &sthttp.SpeedtestConfig{},
+			Config:          &sthttp.Config{ThreadCount: 4, DownloadThreadsPerURL: 2},
+			Timeout:         (15 * time.Second),
+		},
+		DLSizes: []int{350, 500, 750},
+	}
+
+	got, err := client.Download(sthttp.Server{URL: ts.URL + "/upload.php"})
+	if err != nil {
+		t.Fatalf("Client.Download() error = %v", err)
+	}
+	if got <= 0 {
+		t.Errorf("Client.Download() = %v, want greater than 0", got)
+	}
+	if requests != 6 {
+		t.Errorf("Client.Download() made %d requests, want 6", requests)
+	}
+	if peak < 2 {
+		t.Errorf("Client.Download() peak concurrency = %d, want at least 2", peak)
+	}
+}
+
+func TestClient_UploadContentLength(t *testing.T) {
+	var sized, requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		atomic.AddInt64(&requests, 1)
+		if r.ContentLength == int64(len(b)) && len(r.TransferEncoding) == 0 {
+			atomic.AddInt64(&sized, 1)
+		}
+		fmt.Fprintln(w, "size=", len(b))
+	}))
+	defer ts.Close()
+
+	var progress []Progress
+	client := &Client{
+		HTTPClient: &sthttp.Client{
+			SpeedtestConfig: &sthttp.SpeedtestConfig{},
+			Timeout:         (15 * time.Second),
+		},
+		ULSizes:  []int{512, 1024},
+		Progress: func(p Progress) { progress = append(progress, p) },
+	}
+
+	if _, err := client.Upload(sthttp.Server{URL: ts.URL + "/upload.php"}); err != nil {
+		t.Fatalf("Client.Upload() error = %v", err)
+	}
+	if requests == 0 || sized != requests {
+		t.Errorf("Client.Upload() sent %d of %d requests with a Content-Length, want all", sized, requests)
+	}
+	if len(progress) == 0 || progress[len(progress)-1].Bytes != 512+1024 {
+		t.Errorf("Client.Upload() reported progress %+v, want %d bytes in the end", progress, 512+1024)
+	}
+}
+
+func TestClient_UploadParallel(t *testing.T) {
+	var requests, received int64
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		atomic.AddInt64(&requests, 1)
+		atomic.AddInt64(&received, int64(len(b)))
+		fmt.Fprintln(w, "size=", len(b))
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		HTTPClient: &sthttp.Client{
+			SpeedtestConfig: &sthttp.SpeedtestConfig{},
+			Config: &sthttp.Config{
+				UploadThreads:       2,
+				UploadRatio:         2,
+				UploadMaxChunkSize:  2048,
+				UploadMaxChunkCount: 6,
+			},
+			Timeout: (15 * time.Second),
+		},
+		ULSizes: []int{512, 1024, 4096},
+	}
+
+	got, err := client.Upload(sthttp.Server{URL: ts.URL + "/upload.php"})
+	if err != nil {
+		t.Fatalf("Client.Upload() error = %v", err)
+	}
+	if got <= 0 {
+		t.Errorf("Client.Upload() = %v, want greater than 0", got)
+	}
+	if requests != 6 {
+		t.Errorf("Client.Upload() made %d requests, want 6", requests)
+	}
+	// the ratio skips 512 and the 4096 uploads are capped at 2048
+	if received != 3*1024+3*2048 {
+		t.Errorf("Client.Upload() sent %d bytes, want %d", received, 3*1024+3*2048)
+	}
+}
+
+func TestClient_TimeBounded(t *testing.T) {
+	var requests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		ioutil.ReadAll(r.Body)
+		time.Sleep(10 * time.Millisecond)
+		w.Write(make([]byte, 1024))
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		HTTPClient: &sthttp.Client{
+			SpeedtestConfig: &sthttp.SpeedtestConfig{},
+			Config: &sthttp.Config{
+				DownloadTestLength: 200 * time.Millisecond,
+				UploadTestLength:   200 * time.Millisecond,
+			},
+			Timeout: (15 * time.Second),
+		},
+		DLSizes:     []int{350},
+		ULSizes:     []int{1024},
+		TimeBounded: true,
+	}
+	server := sthttp.Server{URL: ts.URL + "/upload.php"}
+
+	for _, test := range []func(sthttp.Server) (float64, error){client.Download, client.Upload} {
+		atomic.StoreInt32(&requests, 0)
+		start := time.Now()
+
+		got, err := test(server)
+		if err != nil {
+			t.Fatalf("time bounded test error = %v", err)
+		}
+		if got <= 0 {
+			t.Errorf("time bounded test = %v, want greater than 0", got)
+		}
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+			t.Errorf("time bounded test took %v, want about 200ms", elapsed)
+		}
+		if n := atomic.LoadInt32(&requests); n < 2 {
+			t.Errorf("time bounded test made %d requests, want more than one pass over the sizes", n)
+		}
+	}
+}
+
+func TestClient_DownloadContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintln(w, "Hello World")
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		HTTPClient: &sthttp.Client{
+			SpeedtestConfig: &sthttp.SpeedtestConfig{NumLatencyTests: 1},
+			Timeout:         (15 * time.Second),
+		},
+		DLSizes: DefaultDLSizes,
+		ULSizes: []int{1024, 1024},
+	}
+	server := sthttp.Server{URL: ts.URL + "/upload.php"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 75*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := client.DownloadContext(ctx, server); err != context.DeadlineExceeded {
+		t.Errorf("Client.DownloadContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := client.UploadContext(ctx, server); err != context.DeadlineExceeded {
+		t.Errorf("Client.UploadContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled test took %v to return", elapsed)
+	}
+}
+
+func TestClient_Logger(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		fmt.Fprintln(w, "Hello World")
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	client := &Client{
+		HTTPClient: &sthttp.Client{
+			SpeedtestConfig: &sthttp.SpeedtestConfig{},
+			Timeout:         (15 * time.Second),
+			Logger:          slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		},
+		DLSizes: []int{350},
+		ULSizes: []int{1024},
+	}
+	server := sthttp.Server{ID: "7", URL: ts.URL + "/speedtest/upload.php"}
+
+	if _, err := client.Download(server); err != nil {
+		t.Fatalf("Client.Download() error = %v", err)
+	}
+	if _, err := client.Upload(server); err != nil {
+		t.Fatalf("Client.Upload() error = %v", err)
+	}
+
+	got := buf.String()
+	for _, want := range []string{
+		`msg="starting download test" server=7 requests=1 threads=1`,
+		`msg="test finished" phase=download bytes=12`,
+		`msg="starting upload test" server=7`,
+		`msg="test finished" phase=upload bytes=1024`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log is missing %q in:\n%s", want, got)
+		}
+	}
+}
+
 func TestClient_GetServer(t *testing.T) {
 	x, err := ioutil.ReadFile("http/sthttp_test_servers.xml")
 	if err != nil {
@@ -291,22 +617,98 @@ func TestClient_GetServer(t *testing.T) {
 	}
 }
 
+func TestClient_GetServerAllowlist(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/servers":
+			fmt.Fprintf(w, `<settings><servers>
+<server url="%[1]s/near/upload.php" lat="32.5" lon="-90.1" name="Near" sponsor="Other ISP" id="1" />
+<server url="%[1]s/slow/upload.php" lat="40.7" lon="-74.0" name="Slow" sponsor="Our ISP" id="2" />
+<server url="%[1]s/fast/upload.php" lat="47.6" lon="-122.3" name="Fast" sponsor="Our ISP" id="3" />
+<server url="http://127.0.0.1:1/down/upload.php" lat="32.5" lon="-90.1" name="Down" sponsor="Our ISP" id="4" />
+</servers></settings>`, ts.URL)
+		case "/slow/latency.txt":
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintln(w, "test=test")
+		default:
+			fmt.Fprintln(w, "test=test")
+		}
+	}))
+	defer ts.Close()
+
+	newClient := func(allowlist ...string) *Client {
+		return &Client{
+			HTTPClient: &sthttp.Client{
+				SpeedtestConfig: &sthttp.SpeedtestConfig{ServersURL: ts.URL + "/servers", NumClosest: 1, NumLatencyTests: 1, Allowlist: allowlist},
+				Config:          &sthttp.Config{Lat: 32.5155, Lon: -90.1118},
+				Timeout:         (15 * time.Second),
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		allowlist []string
+		serverID  string
+		wantID    string
+		wantErr   error
+	}{
+		{name: "fastest allowlisted server", allowlist: []string{"2", "3", "4"}, wantID: "3"},
+		{name: "allowlisted server by id", allowlist: []string{"2", "3"}, serverID: "2", wantID: "2"},
+		{name: "server outside the allowlist", allowlist: []string{"2", "3"}, serverID: "1", wantErr: ErrServerNotAllowed},
+		{name: "allowlist not in the server list", allowlist: []string{"99"}, wantErr: ErrNoServersAvailable},
+		{name: "no allowlisted server reachable", allowlist: []string{"4"}, wantErr: ErrNoServersAvailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newClient(tt.allowlist...).GetServer(tt.serverID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Client.GetServer() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if got.ID != tt.wantID {
+				t.Errorf("Client.GetServer() = %v, want %v", got.ID, tt.wantID)
+			}
+		})
+	}
+}
+
 func TestClient_FindServer(t *testing.T) {
+	servers := []sthttp.Server{{ID: "1"}, {ID: "2630", Sponsor: "Telepak"}}
+
 	type args struct {
 		id          string
 		serversList []sthttp.Server
 	}
 	tests := []struct {
-		name   string
-		client *Client
-		args   args
-		want   http.Server
+		name    string
+		client  *Client
+		args    args
+		want    sthttp.Server
+		wantErr error
 	}{
-		// TODO: Add test cases.
+		{
+			name:   "found",
+			client: &Client{},
+			args:   args{id: "2630", serversList: servers},
+			want:   sthttp.Server{ID: "2630", Sponsor: "Telepak"},
+		},
+		{
+			name:    "missing",
+			client:  &Client{},
+			args:    args{id: "3", serversList: servers},
+			want:    sthttp.Server{},
+			wantErr: ErrServerNotFound,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := tt.client.FindServer(tt.args.id, tt.args.serversList); !reflect.DeepEqual(got, tt.want) {
+			got, err := tt.client.FindServer(tt.args.id, tt.args.serversList)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Client.FindServer() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Client.FindServer() = %v, want %v", got, tt.want)
 			}
 		})
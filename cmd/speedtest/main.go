@@ -0,0 +1,297 @@
+// Command speedtest runs speedtest.net tests from the command line.
+//
+// Usage:
+//
+//	speedtest [flags]        run a full test
+//	speedtest list [flags]   list the available servers, closest first
+//	speedtest serve [flags]  serve results as Prometheus metrics
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	stdhttp "net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kylegrantlucas/speedtest"
+	"github.com/kylegrantlucas/speedtest/exporter"
+	"github.com/kylegrantlucas/speedtest/http"
+)
+
+// options are the flags shared by every subcommand
+type options struct {
+	algo      string
+	timeout   time.Duration
+	format    string
+	blacklist string
+	allowlist string
+	iface     string
+	fresh     bool
+
+	configFile  string
+	serversFile string
+	cacheFile   string
+	cacheTTL    time.Duration
+	retries     int
+	failover    bool
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.algo, "algo", "max", "how samples are combined: max or avg")
+	fs.DurationVar(&o.timeout, "timeout", 30*time.Second, "timeout for each request")
+	fs.StringVar(&o.format, "format", formatText, "output format: text, json or csv")
+	fs.StringVar(&o.blacklist, "blacklist", "", "comma separated server IDs to never use")
+	fs.StringVar(&o.allowlist, "allowlist", "", "comma separated server IDs to choose the fastest from")
+	fs.StringVar(&o.iface, "interface", "", "network interface name or source IP address to test from")
+	fs.BoolVar(&o.fresh, "fresh", false, "open a new connection for every request instead of reusing them")
+	fs.StringVar(&o.configFile, "config-file", "", "load the config from a saved speedtest-config.php response")
+	fs.StringVar(&o.serversFile, "servers-file", "", "load the server list from a saved speedtest-servers-static.php response")
+	fs.StringVar(&o.cacheFile, "cache-file", "", "cache the server list in this file between runs")
+	fs.BoolVar(&o.failover, "failover", false, "move on to the next best server when the chosen one fails mid-test")
+	fs.IntVar(&o.retries, "retries", 0, "retry failed requests this many times, backing off between tries")
+	fs.DurationVar(&o.cacheTTL, "cache-ttl", http.DefaultServerCacheTTL, "how long a cached server list is used before revalidating it")
+}
+
+func (o *options) validate() error {
+	if o.algo != "max" && o.algo != "avg" {
+		return fmt.Errorf("unknown -algo %q, want max or avg", o.algo)
+	}
+	if o.format != formatText && o.format != formatJSON && o.format != formatCSV {
+		return fmt.Errorf("unknown -format %q, want text, json or csv", o.format)
+	}
+	return nil
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run dispatches args to a subcommand and returns the exit code
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	var err error
+	switch {
+	case len(args) > 0 && args[0] == "list":
+		err = list(ctx, args[1:], stdout, stderr)
+	case len(args) > 0 && args[0] == "serve":
+		err = serve(ctx, args[1:], stderr)
+	default:
+		err = test(ctx, args, stdout, stderr)
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "speedtest: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// test runs a full speedtest and writes its result
+func test(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	var opts options
+	var serverID, dlsizes, ulsizes string
+
+	fs := flag.NewFlagSet("speedtest", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	opts.register(fs)
+	fs.StringVar(&serverID, "server", "", "ID of the server to test against, the fastest nearby one when empty")
+	fs.StringVar(&dlsizes, "dlsizes", joinSizes(speedtest.DefaultDLSizes), "comma separated download image sizes")
+	fs.StringVar(&ulsizes, "ulsizes", joinSizes(speedtest.DefaultULSizes), "comma separated upload sizes in bytes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	dl, err := parseSizes(dlsizes)
+	if err != nil {
+		return fmt.Errorf("invalid -dlsizes: %v", err)
+	}
+	ul, err := parseSizes(ulsizes)
+	if err != nil {
+		return fmt.Errorf("invalid -ulsizes: %v", err)
+	}
+
+	client, err := newClient(opts, dl, ul)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.Run(ctx, serverID)
+	if err != nil {
+		return err
+	}
+
+	return writeResult(stdout, opts.format, result)
+}
+
+// list writes the servers in the speedtest.net list matching the query flags, closest first
+func list(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	var opts options
+	var query http.ServerQuery
+
+	fs := flag.NewFlagSet("speedtest list", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	opts.register(fs)
+	fs.StringVar(&query.Country, "country", "", "only list servers in this country")
+	fs.StringVar(&query.CC, "cc", "", "only list servers with this country code")
+	fs.StringVar(&query.Sponsor, "sponsor", "", "only list servers whose sponsor contains this")
+	fs.StringVar(&query.Name, "name", "", "only list servers whose name contains this")
+	fs.Float64Var(&query.Radius, "radius", 0, "only list servers within this many km, 0 for any distance")
+	fs.IntVar(&query.Max, "max", 0, "list at most this many servers, 0 for all of them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	client, err := newClient(opts, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	servers, err := client.ListServersContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	return writeServers(stdout, opts.format, servers)
+}
+
+// serve exposes speedtest results as Prometheus metrics until ctx is done,
+// testing every -interval or, when that is 0, on every scrape
+func serve(ctx context.Context, args []string, stderr io.Writer) error {
+	var opts options
+	var serverID, dlsizes, ulsizes, listen string
+	var interval, jitter time.Duration
+
+	fs := flag.NewFlagSet("speedtest serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	opts.register(fs)
+	fs.StringVar(&serverID, "server", "", "ID of the server to test against, the fastest nearby one when empty")
+	fs.StringVar(&dlsizes, "dlsizes", joinSizes(speedtest.DefaultDLSizes), "comma separated download image sizes")
+	fs.StringVar(&ulsizes, "ulsizes", joinSizes(speedtest.DefaultULSizes), "comma separated upload sizes in bytes")
+	fs.StringVar(&listen, "listen", ":9112", "address to serve /metrics on")
+	fs.DurationVar(&interval, "interval", 15*time.Minute, "test on this interval, or on every scrape when 0, which needs a scrape timeout longer than a full test")
+	fs.DurationVar(&jitter, "jitter", 0, "delay each scheduled test by up to this much")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	dl, err := parseSizes(dlsizes)
+	if err != nil {
+		return fmt.Errorf("invalid -dlsizes: %v", err)
+	}
+	ul, err := parseSizes(ulsizes)
+	if err != nil {
+		return fmt.Errorf("invalid -ulsizes: %v", err)
+	}
+
+	client, err := newClient(opts, dl, ul)
+	if err != nil {
+		return err
+	}
+
+	metrics := exporter.New(client, serverID)
+	if interval > 0 {
+		metrics.OnDemand = false
+		scheduler := &speedtest.Scheduler{
+			Client:   client,
+			ServerID: serverID,
+			Interval: interval,
+			Jitter:   jitter,
+			OnResult: metrics.Record,
+		}
+		go scheduler.Run(ctx)
+	}
+
+	mux := stdhttp.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &stdhttp.Server{Addr: listen, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.ListenAndServe(); err != stdhttp.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func newClient(opts options, dlsizes []int, ulsizes []int) (*speedtest.Client, error) {
+	config := speedtest.NewDefaultConfig()
+	config.AlgoType = opts.algo
+	config.Interface = opts.iface
+	config.FreshConnections = opts.fresh
+	config.ConfigFile = opts.configFile
+	config.ServersFile = opts.serversFile
+	if opts.retries > 0 {
+		config.Retry = &http.RetryPolicy{Attempts: opts.retries + 1, Backoff: 500 * time.Millisecond, MaxBackoff: 5 * time.Second}
+	}
+	if opts.cacheFile != "" {
+		config.ServerCache = http.NewFileCache(opts.cacheFile)
+		config.ServerCacheTTL = opts.cacheTTL
+	}
+	if opts.blacklist != "" {
+		config.Blacklist = strings.Split(opts.blacklist, ",")
+	}
+	if opts.allowlist != "" {
+		config.Allowlist = strings.Split(opts.allowlist, ",")
+	}
+
+	client, err := speedtest.NewClient(config, dlsizes, ulsizes, opts.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Failover = opts.failover
+	return client, nil
+}
+
+// parseSizes parses a comma separated list of sizes
+func parseSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(s, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if size <= 0 {
+			return nil, fmt.Errorf("size %d is not positive", size)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+func joinSizes(sizes []int) string {
+	fields := make([]string, len(sizes))
+	for i, size := range sizes {
+		fields[i] = strconv.Itoa(size)
+	}
+	return strings.Join(fields, ",")
+}
+
+// describe names a server the way speedtest.net does
+func describe(server http.Server) string {
+	return fmt.Sprintf("%s (%s, %s)", server.Sponsor, server.Name, server.Country)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylegrantlucas/speedtest"
+	"github.com/kylegrantlucas/speedtest/http"
+)
+
+func TestParseSizes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{in: "350", want: []int{350}},
+		{in: "350, 500,750", want: []int{350, 500, 750}},
+		{in: "350,big", wantErr: true},
+		{in: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSizes(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSizes() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSizes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunRejectsBadFlags(t *testing.T) {
+	tests := [][]string{
+		{"-algo", "median"},
+		{"-format", "xml"},
+		{"-dlsizes", "a,b"},
+		{"list", "-format", "yaml"},
+		{"serve", "-dlsizes", "0"},
+	}
+	for _, args := range tests {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := run(context.Background(), args, &stdout, &stderr); code == 0 {
+				t.Errorf("run() = 0, want a failure exit code")
+			}
+		})
+	}
+}
+
+func TestWriteResult(t *testing.T) {
+	result := speedtest.Result{
+		Server:   http.Server{ID: "2630", Sponsor: "Telepak", Name: "Jackson, MS", Country: "United States", Distance: 12.5},
+		Latency:  20.5,
+		Jitter:   1.25,
+		Download: 94.2,
+		Upload:   11.8,
+		Start:    time.Date(2018, 4, 19, 12, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: formatText,
+			want:   "Server: Telepak (Jackson, MS, United States) [2630, 12.50 km]\nPing: 20.50 ms | Jitter: 1.25 ms | Download: 94.20 Mbps | Upload: 11.80 Mbps\n",
+		},
+		{
+			format: formatCSV,
+			want: "start,server_id,sponsor,server_name,country,distance_km,latency_ms,jitter_ms,download_mbps,upload_mbps,bytes_received,bytes_sent,client_ip,isp,download_server_id,upload_server_id\n" +
+				"2018-04-19T12:00:00Z,2630,Telepak,\"Jackson, MS\",United States,12.50,20.50,1.25,94.20,11.80,0,0,,,2630,2630\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := writeResult(&b, tt.format, result); err != nil {
+				t.Fatalf("writeResult() error = %v", err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("writeResult() = %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+
+	t.Run(formatJSON, func(t *testing.T) {
+		var b bytes.Buffer
+		if err := writeResult(&b, formatJSON, result); err != nil {
+			t.Fatalf("writeResult() error = %v", err)
+		}
+		var decoded speedtest.Result
+		if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+			t.Fatalf("writeResult() wrote invalid JSON %q: %v", b.String(), err)
+		}
+		if decoded.Server.ID != "2630" || decoded.Download != 94.2 {
+			t.Errorf("writeResult() = %q", b.String())
+		}
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		failedOver := result
+		failedOver.DownloadServerID = "4600"
+		failedOver.UploadServerID = "4600"
+
+		var b bytes.Buffer
+		if err := writeResult(&b, formatText, failedOver); err != nil {
+			t.Fatalf("writeResult() error = %v", err)
+		}
+		if want := "Failed over: download from server 4600, upload to server 4600\n"; !strings.HasSuffix(b.String(), want) {
+			t.Errorf("writeResult() = %q, want it to end with %q", b.String(), want)
+		}
+	})
+}
+
+func TestWriteServers(t *testing.T) {
+	servers := []http.Server{
+		{ID: "2630", Sponsor: "Telepak", Name: "Jackson, MS", Country: "United States", CC: "US", Distance: 12.5},
+		{ID: "4600", Sponsor: "Varanger", Name: "Vadso", Country: "Norway", CC: "NO", Distance: 7400},
+	}
+
+	var b bytes.Buffer
+	if err := writeServers(&b, formatText, servers); err != nil {
+		t.Fatalf("writeServers() error = %v", err)
+	}
+	want := "  2630) Telepak (Jackson, MS, United States) [12.50 km]\n  4600) Varanger (Vadso, Norway) [7400.00 km]\n"
+	if b.String() != want {
+		t.Errorf("writeServers() = %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/kylegrantlucas/speedtest"
+	"github.com/kylegrantlucas/speedtest/http"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+var resultHeader = []string{
+	"start", "server_id", "sponsor", "server_name", "country", "distance_km",
+	"latency_ms", "jitter_ms", "download_mbps", "upload_mbps",
+	"bytes_received", "bytes_sent", "client_ip", "isp",
+	"download_server_id", "upload_server_id",
+}
+
+var serverHeader = []string{"id", "sponsor", "name", "country", "cc", "distance_km", "url"}
+
+// writeResult writes result to w in format
+func writeResult(w io.Writer, format string, result speedtest.Result) error {
+	downloadServerID := measuredOn(result.DownloadServerID, result.Server)
+	uploadServerID := measuredOn(result.UploadServerID, result.Server)
+
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(w).Encode(result)
+	case formatCSV:
+		return writeCSV(w, resultHeader, [][]string{{
+			result.Start.Format(time.RFC3339),
+			result.Server.ID,
+			result.Server.Sponsor,
+			result.Server.Name,
+			result.Server.Country,
+			formatFloat(result.Server.Distance),
+			formatFloat(result.Latency),
+			formatFloat(result.Jitter),
+			formatFloat(result.Download),
+			formatFloat(result.Upload),
+			strconv.FormatInt(result.BytesReceived, 10),
+			strconv.FormatInt(result.BytesSent, 10),
+			result.ClientIP,
+			result.ISP,
+			downloadServerID,
+			uploadServerID,
+		}})
+	default:
+		_, err := fmt.Fprintf(w, "Server: %s [%s, %.2f km]\nPing: %3.2f ms | Jitter: %3.2f ms | Download: %3.2f Mbps | Upload: %3.2f Mbps\n",
+			describe(result.Server), result.Server.ID, result.Server.Distance,
+			result.Latency, result.Jitter, result.Download, result.Upload)
+		if err == nil && (downloadServerID != result.Server.ID || uploadServerID != result.Server.ID) {
+			_, err = fmt.Fprintf(w, "Failed over: download from server %s, upload to server %s\n", downloadServerID, uploadServerID)
+		}
+		return err
+	}
+}
+
+// measuredOn returns id, the server a speed was measured against, or the
+// ID of server, the one tested, for a result that does not record it
+func measuredOn(id string, server http.Server) string {
+	if id == "" {
+		return server.ID
+	}
+	return id
+}
+
+// writeServers writes servers to w in format
+func writeServers(w io.Writer, format string, servers []http.Server) error {
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(w).Encode(servers)
+	case formatCSV:
+		var rows [][]string
+		for _, server := range servers {
+			rows = append(rows, []string{
+				server.ID, server.Sponsor, server.Name, server.Country, server.CC,
+				formatFloat(server.Distance), server.URL,
+			})
+		}
+		return writeCSV(w, serverHeader, rows)
+	default:
+		for _, server := range servers {
+			if _, err := fmt.Fprintf(w, "%6s) %s [%.2f km]\n", server.ID, describe(server), server.Distance); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func writeCSV(w io.Writer, header []string, rows [][]string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
@@ -0,0 +1,21 @@
+package speedtest
+
+import "github.com/kylegrantlucas/speedtest/http"
+
+// The errors returned by the http package, so callers of this package can
+// check them with errors.Is and errors.As without importing it
+var (
+	// ErrNoServersAvailable is returned when no candidate server could be measured
+	ErrNoServersAvailable = http.ErrNoServersAvailable
+	// ErrServerNotFound is returned when a server ID is not in the server list
+	ErrServerNotFound = http.ErrServerNotFound
+	// ErrServerNotAllowed is returned when a server ID is left out of the config's Allowlist
+	ErrServerNotAllowed = http.ErrServerNotAllowed
+)
+
+// HTTPStatusError is returned when speedtest.net or a test server answers
+// with a status other than 200 OK
+type HTTPStatusError = http.HTTPStatusError
+
+// ParseError is returned when a config XML attribute cannot be parsed
+type ParseError = http.ParseError
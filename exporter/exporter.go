@@ -0,0 +1,202 @@
+// Package exporter exposes speedtest results to Prometheus in its text
+// exposition format, either from scheduled runs or by testing on every
+// scrape.
+package exporter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kylegrantlucas/speedtest"
+	sthttp "github.com/kylegrantlucas/speedtest/http"
+)
+
+// ContentType is the content type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Exporter serves the latest speedtest result as Prometheus metrics. Feed
+// it results by setting Record as a Scheduler's OnResult, or set OnDemand
+// to run a test whenever it is scraped.
+type Exporter struct {
+	Client *speedtest.Client
+	// ServerID is the server on demand tests run against, the fastest nearby one when empty
+	ServerID string
+	// OnDemand runs a test on every scrape instead of serving the last
+	// recorded result. The test is bound to the scrape, so the scrape
+	// timeout must be longer than a full test, which with the default sizes
+	// takes longer than Prometheus' default of 10s. A scrape that times out
+	// first records nothing.
+	OnDemand bool
+	// Logger receives failures to write a scrape response, http.NopLogger when nil
+	Logger speedtest.Logger
+
+	// running serialises on demand tests so concurrent scrapes never overlap
+	running sync.Mutex
+
+	mu   sync.Mutex
+	last *speedtest.Result
+	// downloadServer and uploadServer are the servers last's speeds were
+	// measured against, which differ from last.Server after a failover
+	downloadServer sthttp.Server
+	uploadServer   sthttp.Server
+	lastRun        time.Time
+	up             bool
+	runs           uint64
+	failures       uint64
+}
+
+// New returns an Exporter that tests against serverID on every scrape, see OnDemand
+func New(client *speedtest.Client, serverID string) *Exporter {
+	return &Exporter{Client: client, ServerID: serverID, OnDemand: true}
+}
+
+// Record counts a finished run and, when it succeeded, makes its result the one served
+func (e *Exporter) Record(result speedtest.Result, err error) {
+	downloadServer := e.server(result.DownloadServerID, result.Server)
+	uploadServer := e.server(result.UploadServerID, result.Server)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.runs++
+	e.lastRun = result.End
+	if e.lastRun.IsZero() {
+		e.lastRun = time.Now()
+	}
+
+	e.up = err == nil
+	if err != nil {
+		e.failures++
+		return
+	}
+	e.last = &result
+	e.downloadServer = downloadServer
+	e.uploadServer = uploadServer
+}
+
+// server returns the server with id, looking it up in the client's
+// Candidates when a failover moved the test away from tested. A server
+// that cannot be found is described by its ID alone.
+func (e *Exporter) server(id string, tested sthttp.Server) sthttp.Server {
+	if id == "" || id == tested.ID {
+		return tested
+	}
+	if e.Client != nil {
+		for _, candidate := range e.Client.Candidates() {
+			if candidate.ID == id {
+				return candidate
+			}
+		}
+	}
+	return sthttp.Server{ID: id}
+}
+
+// ServeHTTP writes the metrics, running a test first when OnDemand is set
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if e.OnDemand {
+		e.run(r.Context())
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	if err := e.Write(w); err != nil {
+		e.logger().Warn("error writing speedtest metrics", "error", err)
+	}
+}
+
+func (e *Exporter) run(ctx context.Context) {
+	e.running.Lock()
+	defer e.running.Unlock()
+
+	result, err := e.Client.Run(ctx, e.ServerID)
+	if err != nil && ctx.Err() != nil {
+		// the scraper gave up, which says nothing about the connection
+		return
+	}
+	e.Record(result, err)
+}
+
+// Write writes the metrics in the Prometheus text exposition format
+func (e *Exporter) Write(w io.Writer) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	counter(bw, "speedtest_runs_total", "Speedtest runs, successful or not.", e.runs)
+	counter(bw, "speedtest_errors_total", "Speedtest runs that failed.", e.failures)
+	gauge(bw, "speedtest_up", "Whether the last speedtest run succeeded.", "", boolFloat(e.up))
+	if !e.lastRun.IsZero() {
+		gauge(bw, "speedtest_last_run_timestamp_seconds", "When the last speedtest run finished.", "", float64(e.lastRun.UnixNano())/1e9)
+	}
+
+	if e.last != nil {
+		server := e.last.Server
+		labels := serverLabels(server)
+		downloadLabels := serverLabels(e.downloadServer)
+		uploadLabels := serverLabels(e.uploadServer)
+
+		gauge(bw, "speedtest_download_mbps", "Download speed of the last successful run in Mbps.", downloadLabels, e.last.Download)
+		gauge(bw, "speedtest_upload_mbps", "Upload speed of the last successful run in Mbps.", uploadLabels, e.last.Upload)
+		gauge(bw, "speedtest_latency_ms", "Latency of the last successful run in milliseconds.", labels, e.last.Latency)
+		gauge(bw, "speedtest_jitter_ms", "Latency jitter of the last successful run in milliseconds.", labels, e.last.Jitter)
+		gauge(bw, "speedtest_server_distance_km", "Distance to the server of the last successful run in km.", labels, server.Distance)
+		gauge(bw, "speedtest_received_bytes", "Bytes received by the last successful run.", downloadLabels, float64(e.last.BytesReceived))
+		gauge(bw, "speedtest_sent_bytes", "Bytes sent by the last successful run.", uploadLabels, float64(e.last.BytesSent))
+	}
+
+	return bw.Flush()
+}
+
+func (e *Exporter) logger() speedtest.Logger {
+	if e.Logger == nil {
+		return sthttp.NopLogger
+	}
+	return e.Logger
+}
+
+func counter(w io.Writer, name, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func gauge(w io.Writer, name, help, labels string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s%s %s\n", name, help, name, name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// serverLabels formats the label set identifying server
+func serverLabels(server sthttp.Server) string {
+	return formatLabels(
+		"server_id", server.ID,
+		"sponsor", server.Sponsor,
+		"name", server.Name,
+		"country", server.Country,
+	)
+}
+
+// formatLabels formats name, value pairs as a label set
+func formatLabels(pairs ...string) string {
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, pairs[i]+`="`+escapeLabel(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package exporter
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylegrantlucas/speedtest"
+	sthttp "github.com/kylegrantlucas/speedtest/http"
+	"github.com/kylegrantlucas/speedtest/server"
+)
+
+func TestExporter_Write(t *testing.T) {
+	e := &Exporter{}
+	e.Record(speedtest.Result{
+		Server:   sthttp.Server{ID: "2630", Sponsor: `Telepak "Networks"`, Name: "Jackson, MS", Country: "United States"},
+		Latency:  12.5,
+		Jitter:   1.25,
+		Download: 93.4,
+		Upload:   11,
+		End:      time.Unix(1500000000, 0),
+	}, nil)
+	e.Record(speedtest.Result{End: time.Unix(1500000300, 0)}, errors.New("no servers available"))
+
+	var b strings.Builder
+	if err := e.Write(&b); err != nil {
+		t.Fatalf("Exporter.Write() error = %v", err)
+	}
+	got := b.String()
+
+	labels := `{server_id="2630",sponsor="Telepak \"Networks\"",name="Jackson, MS",country="United States"}`
+	for _, want := range []string{
+		"# TYPE speedtest_runs_total counter\nspeedtest_runs_total 2\n",
+		"speedtest_errors_total 1\n",
+		"speedtest_up 0\n",
+		"speedtest_last_run_timestamp_seconds 1.5000003e+09\n",
+		"# TYPE speedtest_download_mbps gauge\nspeedtest_download_mbps" + labels + " 93.4\n",
+		"speedtest_upload_mbps" + labels + " 11\n",
+		"speedtest_latency_ms" + labels + " 12.5\n",
+		"speedtest_jitter_ms" + labels + " 1.25\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Exporter.Write() is missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestExporter_WriteFailover(t *testing.T) {
+	e := &Exporter{}
+	e.Record(speedtest.Result{
+		Server:           sthttp.Server{ID: "1", Sponsor: "Broken", Name: "Near", Country: "United States"},
+		Latency:          12.5,
+		Download:         93.4,
+		Upload:           11,
+		DownloadServerID: "2",
+		UploadServerID:   "1",
+	}, nil)
+
+	var b strings.Builder
+	if err := e.Write(&b); err != nil {
+		t.Fatalf("Exporter.Write() error = %v", err)
+	}
+	got := b.String()
+
+	for _, want := range []string{
+		`speedtest_download_mbps{server_id="2",sponsor="",name="",country=""} 93.4` + "\n",
+		`speedtest_upload_mbps{server_id="1",sponsor="Broken",name="Near",country="United States"} 11` + "\n",
+		`speedtest_latency_ms{server_id="1",sponsor="Broken",name="Near",country="United States"} 12.5` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Exporter.Write() is missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestExporter_WriteNoResult(t *testing.T) {
+	var b strings.Builder
+	if err := (&Exporter{}).Write(&b); err != nil {
+		t.Fatalf("Exporter.Write() error = %v", err)
+	}
+	if strings.Contains(b.String(), "speedtest_download_mbps") {
+		t.Errorf("Exporter.Write() wrote speeds before any run:\n%s", b.String())
+	}
+}
+
+func TestExporter_OnDemand(t *testing.T) {
+	ts := httptest.NewServer(&server.Server{ID: "1", Sponsor: "Lab", Sizes: []int{350}})
+	defer ts.Close()
+
+	client, err := speedtest.NewClient(&sthttp.SpeedtestConfig{
+		ConfigURL:       ts.URL + server.ConfigPath,
+		ServersURL:      ts.URL + server.ServersPath,
+		NumClosest:      1,
+		NumLatencyTests: 1,
+	}, []int{350}, []int{1024}, 15*time.Second)
+	if err != nil {
+		t.Fatalf("speedtest.NewClient() error = %v", err)
+	}
+
+	metrics := httptest.NewServer(New(client, ""))
+	defer metrics.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(metrics.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ct := resp.Header.Get("Content-Type"); ct != ContentType {
+			t.Errorf("Content-Type = %q, want %q", ct, ContentType)
+		}
+		body := string(b)
+		if !strings.Contains(body, "speedtest_up 1\n") || !strings.Contains(body, `speedtest_download_mbps{server_id="1",sponsor="Lab"`) {
+			t.Errorf("scrape %d did not report a successful run:\n%s", i+1, body)
+		}
+		if want := "speedtest_runs_total " + strconv.Itoa(i+1) + "\n"; !strings.Contains(body, want) {
+			t.Errorf("scrape %d is missing %q", i+1, want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package speedtest
+
+import (
+	"context"
+
+	"github.com/kylegrantlucas/speedtest/http"
+)
+
+// withFailover runs a test phase against server and, when Failover is set
+// and it fails, against each candidate ranked after server in turn. The
+// samples of the failed attempts are kept in the returned transfer's
+// Earlier samples.
+func (client *Client) withFailover(ctx context.Context, phase string, server http.Server, run func(context.Context, http.Server) (transfer, int, error)) (transfer, int, error) {
+	var earlier []Sample
+	next := client.candidatesAfter(server.ID)
+
+	for {
+		t, threads, err := run(ctx, server)
+		t.tag(server.ID)
+		t.Earlier = earlier
+
+		if err == nil || !client.Failover || ctx.Err() != nil || len(next) == 0 {
+			return t, threads, err
+		}
+
+		client.logger().Info("failing over to the next server", "phase", phase, "from", server.ID, "to", next[0].ID, "error", err)
+		earlier = append(earlier, t.Samples...)
+		server, next = next[0], next[1:]
+	}
+}
+
+// candidatesAfter returns the candidates ranked after the server with id,
+// or none when it is not a candidate
+func (client *Client) candidatesAfter(id string) []http.Server {
+	candidates := client.Candidates()
+	for i, candidate := range candidates {
+		if candidate.ID == id {
+			return candidates[i+1:]
+		}
+	}
+	return nil
+}
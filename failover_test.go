@@ -0,0 +1,114 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sthttp "github.com/kylegrantlucas/speedtest/http"
+)
+
+// failoverClient returns a client whose server list holds a server "1"
+// that fails every download and upload and a slower but healthy server "2"
+func failoverClient(t *testing.T) *Client {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "latency.txt") {
+			fmt.Fprintln(w, "test=test")
+			return
+		}
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(broken.Close)
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "latency.txt") {
+			time.Sleep(50 * time.Millisecond)
+		}
+		ioutil.ReadAll(r.Body)
+		fmt.Fprintln(w, "test=test")
+	}))
+	t.Cleanup(healthy.Close)
+
+	list := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<settings><servers>`+
+			`<server url="%s/speedtest/upload.php" lat="32.5" lon="-90.1" name="Near" country="United States" cc="US" sponsor="Broken" id="1" />`+
+			`<server url="%s/speedtest/upload.php" lat="33.5" lon="-90.1" name="Far" country="United States" cc="US" sponsor="Healthy" id="2" />`+
+			`</servers></settings>`, broken.URL, healthy.URL)
+	}))
+	t.Cleanup(list.Close)
+
+	return &Client{
+		HTTPClient: &sthttp.Client{
+			SpeedtestConfig: &sthttp.SpeedtestConfig{ServersURL: list.URL, NumClosest: 2, NumLatencyTests: 1},
+			Config:          &sthttp.Config{Lat: 32.5155, Lon: -90.1118},
+			Timeout:         (15 * time.Second),
+		},
+		DLSizes: []int{350, 500},
+		ULSizes: []int{1024},
+	}
+}
+
+func TestClient_RankServers(t *testing.T) {
+	client := failoverClient(t)
+
+	ranked, err := client.RankServersContext(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Client.RankServersContext() error = %v", err)
+	}
+	if len(ranked) != 2 || ranked[0].ID != "1" || ranked[1].ID != "2" {
+		t.Fatalf("Client.RankServersContext() = %v, want servers 1 then 2", ranked)
+	}
+	if got := client.Candidates(); len(got) != 2 || got[0].ID != "1" {
+		t.Errorf("Client.Candidates() = %v, want the ranked servers", got)
+	}
+
+	ranked, err = client.RankServers("2")
+	if err != nil || len(ranked) != 1 || ranked[0].ID != "2" {
+		t.Errorf("Client.RankServers(\"2\") = %v, %v, want only server 2", ranked, err)
+	}
+}
+
+func TestClient_Failover(t *testing.T) {
+	client := failoverClient(t)
+
+	server, err := client.GetServer("")
+	if err != nil {
+		t.Fatalf("Client.GetServer() error = %v", err)
+	}
+	if server.ID != "1" {
+		t.Fatalf("Client.GetServer() = %v, want the faster broken server 1", server.ID)
+	}
+
+	var statusErr *HTTPStatusError
+	if _, err := client.Download(server); !errors.As(err, &statusErr) {
+		t.Errorf("Client.Download() without Failover error = %v, want the broken server's status", err)
+	}
+
+	client.Failover = true
+	if _, err := client.Download(server); err != nil {
+		t.Errorf("Client.Download() with Failover error = %v", err)
+	}
+	if _, err := client.Upload(server); err != nil {
+		t.Errorf("Client.Upload() with Failover error = %v", err)
+	}
+
+	result, err := client.Run(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Client.Run() with Failover error = %v", err)
+	}
+	if result.Server.ID != "1" || result.DownloadServerID != "2" || result.UploadServerID != "2" {
+		t.Errorf("Client.Run() server = %s, download from %s, upload to %s, want 1, 2 and 2", result.Server.ID, result.DownloadServerID, result.UploadServerID)
+	}
+	for _, sample := range result.DownloadSamples {
+		if sample.ServerID != "2" {
+			t.Errorf("Client.Run() download sample from server %q, want 2", sample.ServerID)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package speedtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// HistoryStore records results and returns those started within a time range
+type HistoryStore interface {
+	Append(result Result) error
+	// Query returns the results started at or after from and before to, in
+	// the order they were appended. A zero from or to leaves that end open.
+	Query(from, to time.Time) ([]Result, error)
+}
+
+// inRange reports whether t falls in the half open range [from, to)
+func inRange(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !t.Before(to) {
+		return false
+	}
+	return true
+}
+
+// JSONLinesStore keeps results in a file with one JSON encoded Result per line
+type JSONLinesStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewJSONLinesStore returns a JSONLinesStore appending to the file at path
+func NewJSONLinesStore(path string) *JSONLinesStore {
+	return &JSONLinesStore{Path: path}
+}
+
+// Append writes result as a new line at the end of the file
+func (store *JSONLinesStore) Append(result Result) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	f, err := os.OpenFile(store.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query reads the file and returns the results started within [from, to)
+func (store *JSONLinesStore) Query(from, to time.Time) ([]Result, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	f, err := os.Open(store.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var results []Result
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var result Result
+		if err := json.Unmarshal(line, &result); err != nil {
+			return results, err
+		}
+		if inRange(result.Start, from, to) {
+			results = append(results, result)
+		}
+	}
+	return results, scanner.Err()
+}
+
+// GobStore keeps results in a compact binary file, each Result gob encoded
+// behind a 4 byte big endian length. A record cut short by a crash while
+// appending is ignored by Query and cut off by the next Append.
+type GobStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewGobStore returns a GobStore appending to the file at path
+func NewGobStore(path string) *GobStore {
+	return &GobStore{Path: path}
+}
+
+// Append writes result as a new record at the end of the file
+func (store *GobStore) Append(result Result) error {
+	var record bytes.Buffer
+	record.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&record).Encode(result); err != nil {
+		return err
+	}
+	b := record.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	f, err := os.OpenFile(store.Path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	// Drop a torn final record so the new one starts on a record boundary
+	// instead of being read as the torn record's missing bytes.
+	end, err := completeLength(bufio.NewReader(f))
+	if err == nil {
+		err = f.Truncate(end)
+	}
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// completeLength returns the number of bytes in r taken up by complete records
+func completeLength(r io.Reader) (int64, error) {
+	var end int64
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return end, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header))
+		if _, err := io.CopyN(io.Discard, r, size); err == io.EOF {
+			return end, nil
+		} else if err != nil {
+			return 0, err
+		}
+		end += 4 + size
+	}
+}
+
+// Query reads the file and returns the results started within [from, to)
+func (store *GobStore) Query(from, to time.Time) ([]Result, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	f, err := os.Open(store.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var results []Result
+	r := bufio.NewReader(f)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return results, nil
+		} else if err != nil {
+			return results, err
+		}
+
+		record := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(r, record); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return results, nil
+		} else if err != nil {
+			return results, err
+		}
+
+		var result Result
+		if err := gob.NewDecoder(bytes.NewReader(record)).Decode(&result); err != nil {
+			return results, err
+		}
+		if inRange(result.Start, from, to) {
+			results = append(results, result)
+		}
+	}
+}
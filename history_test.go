@@ -0,0 +1,101 @@
+package speedtest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sthttp "github.com/kylegrantlucas/speedtest/http"
+)
+
+func TestHistoryStore(t *testing.T) {
+	base := time.Date(2017, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		store func(path string) HistoryStore
+	}{
+		{name: "json lines", store: func(path string) HistoryStore { return NewJSONLinesStore(path) }},
+		{name: "gob", store: func(path string) HistoryStore { return NewGobStore(path) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "history")
+			store := tt.store(path)
+
+			if got, err := store.Query(time.Time{}, time.Time{}); err != nil || len(got) != 0 {
+				t.Errorf("Query() on a missing file = %v, %v, want nothing", got, err)
+			}
+
+			for i := 0; i < 4; i++ {
+				result := Result{
+					Server:   sthttp.Server{ID: "2630"},
+					Download: float64(10 * (i + 1)),
+					Start:    base.Add(time.Duration(i) * time.Hour),
+					End:      base.Add(time.Duration(i)*time.Hour + time.Minute),
+				}
+				if err := store.Append(result); err != nil {
+					t.Fatalf("Append() error = %v", err)
+				}
+			}
+
+			got, err := tt.store(path).Query(base.Add(time.Hour), base.Add(3*time.Hour))
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if len(got) != 2 || got[0].Download != 20 || got[1].Download != 30 || got[0].Server.ID != "2630" || !got[0].Start.Equal(base.Add(time.Hour)) {
+				t.Errorf("Query() = %+v, want the second and third results", got)
+			}
+
+			all, err := store.Query(time.Time{}, time.Time{})
+			if err != nil || len(all) != 4 {
+				t.Errorf("Query() unbounded = %d results, %v, want 4", len(all), err)
+			}
+		})
+	}
+}
+
+func TestGobStore_Truncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	store := NewGobStore(path)
+
+	for i := 0; i < 2; i++ {
+		if err := store.Append(Result{Download: float64(i + 1)}); err != nil {
+			t.Fatalf("GobStore.Append() error = %v", err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Query(time.Time{}, time.Time{})
+	if err != nil || len(got) != 1 || got[0].Download != 1 {
+		t.Errorf("GobStore.Query() = %+v, %v, want only the complete first result", got, err)
+	}
+
+	for i := 2; i < 7; i++ {
+		if err := store.Append(Result{Download: float64(i + 1)}); err != nil {
+			t.Fatalf("GobStore.Append() error = %v", err)
+		}
+	}
+
+	got, err = store.Query(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("GobStore.Query() error = %v", err)
+	}
+	want := []float64{1, 3, 4, 5, 6, 7}
+	if len(got) != len(want) {
+		t.Fatalf("GobStore.Query() returned %d results, want %d", len(got), len(want))
+	}
+	for i, result := range got {
+		if result.Download != want[i] {
+			t.Errorf("GobStore.Query()[%d].Download = %v, want %v", i, result.Download, want[i])
+		}
+	}
+}
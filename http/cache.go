@@ -0,0 +1,132 @@
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultServerCacheTTL is how long a cached server list is used without
+// revalidating it when the config sets no ServerCacheTTL
+const DefaultServerCacheTTL = time.Hour
+
+// CachedServers is a server list along with what is needed to revalidate it
+type CachedServers struct {
+	URL          string    `json:"url"`
+	Servers      []Server  `json:"servers"`
+	Fetched      time.Time `json:"fetched"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+}
+
+// sameServersURL reports whether a and b name the same server list once the
+// x cache-buster NewDefaultConfig appends is dropped, as it changes every run
+func sameServersURL(a, b string) bool {
+	return withoutCacheBuster(a) == withoutCacheBuster(b)
+}
+
+func withoutCacheBuster(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	query.Del("x")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// ServerCache stores the server list between runs. Load reports false when
+// nothing is stored.
+type ServerCache interface {
+	Load() (CachedServers, bool, error)
+	Store(CachedServers) error
+}
+
+// MemoryCache keeps the server list for the life of the process
+type MemoryCache struct {
+	mu     sync.Mutex
+	cached *CachedServers
+}
+
+// NewMemoryCache returns an empty MemoryCache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{}
+}
+
+// Load returns the stored server list
+func (cache *MemoryCache) Load() (CachedServers, bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.cached == nil {
+		return CachedServers{}, false, nil
+	}
+	return *cache.cached, true, nil
+}
+
+// Store replaces the stored server list
+func (cache *MemoryCache) Store(cached CachedServers) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.cached = &cached
+	return nil
+}
+
+// FileCache keeps the server list as JSON in a file so it outlives the process
+type FileCache struct {
+	Path string
+}
+
+// NewFileCache returns a FileCache storing the server list at path
+func NewFileCache(path string) *FileCache {
+	return &FileCache{Path: path}
+}
+
+// Load reads the server list from the file, reporting false when it does not exist
+func (cache *FileCache) Load() (CachedServers, bool, error) {
+	var cached CachedServers
+
+	b, err := ioutil.ReadFile(cache.Path)
+	if os.IsNotExist(err) {
+		return cached, false, nil
+	}
+	if err != nil {
+		return cached, false, err
+	}
+
+	if err := json.Unmarshal(b, &cached); err != nil {
+		return CachedServers{}, false, err
+	}
+	return cached, true, nil
+}
+
+// Store writes the server list to a temporary file and renames it into
+// place, so a concurrent Load never sees a partial list
+func (cache *FileCache) Store(cached CachedServers) error {
+	b, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(cache.Path), filepath.Base(cache.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), cache.Path)
+}
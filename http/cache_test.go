@@ -0,0 +1,114 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_ServerCache(t *testing.T) {
+	x, err := ioutil.ReadFile("sthttp_test_servers.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests, revalidations int32
+	var failing int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&revalidations, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(x)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name  string
+		cache func(t *testing.T) ServerCache
+	}{
+		{name: "memory", cache: func(t *testing.T) ServerCache { return NewMemoryCache() }},
+		{name: "file", cache: func(t *testing.T) ServerCache {
+			return NewFileCache(filepath.Join(t.TempDir(), "servers.json"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			atomic.StoreInt32(&revalidations, 0)
+			atomic.StoreInt32(&failing, 0)
+
+			config := &SpeedtestConfig{ServersURL: ts.URL, ServerCache: tt.cache(t), ServerCacheTTL: time.Hour}
+			stClient := &Client{SpeedtestConfig: config, Timeout: 15 * time.Second}
+
+			first, err := stClient.GetServers()
+			if err != nil || len(first) == 0 {
+				t.Fatalf("Client.GetServers() = %d servers, %v", len(first), err)
+			}
+			second, err := stClient.GetServers()
+			if err != nil || len(second) != len(first) {
+				t.Fatalf("Client.GetServers() = %d servers, %v, want %d", len(second), err, len(first))
+			}
+			if got := atomic.LoadInt32(&requests); got != 1 {
+				t.Errorf("fetched the server list %d times within the TTL, want 1", got)
+			}
+
+			config.ServerCacheTTL = time.Nanosecond
+			revalidated, err := stClient.GetServers()
+			if err != nil || len(revalidated) != len(first) {
+				t.Fatalf("Client.GetServers() = %d servers, %v, want %d", len(revalidated), err, len(first))
+			}
+			if got := atomic.LoadInt32(&revalidations); got != 1 {
+				t.Errorf("revalidated the server list %d times, want 1", got)
+			}
+
+			atomic.StoreInt32(&failing, 1)
+			stale, err := stClient.GetServers()
+			if err != nil || len(stale) != len(first) {
+				t.Errorf("Client.GetServers() = %d servers, %v, want the %d stale servers", len(stale), err, len(first))
+			}
+
+			config.ServerCache = tt.cache(t)
+			if _, err := stClient.GetServers(); err == nil {
+				t.Errorf("Client.GetServers() error = nil with an empty cache and a failing server")
+			}
+		})
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.json")
+
+	if _, ok, err := NewFileCache(path).Load(); ok || err != nil {
+		t.Errorf("FileCache.Load() = %v, %v, want nothing stored", ok, err)
+	}
+
+	want := CachedServers{
+		URL:     "http://example.com/servers",
+		Servers: []Server{{ID: "2630", URL: "http://example.com/speedtest/upload.php"}},
+		Fetched: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		ETag:    `"v1"`,
+	}
+	if err := NewFileCache(path).Store(want); err != nil {
+		t.Fatalf("FileCache.Store() error = %v", err)
+	}
+
+	got, ok, err := NewFileCache(path).Load()
+	if !ok || err != nil {
+		t.Fatalf("FileCache.Load() = %v, %v", ok, err)
+	}
+	if got.URL != want.URL || !got.Fetched.Equal(want.Fetched) || got.ETag != want.ETag || len(got.Servers) != 1 || got.Servers[0].ID != "2630" {
+		t.Errorf("FileCache.Load() = %+v, want %+v", got, want)
+	}
+}
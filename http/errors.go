@@ -0,0 +1,51 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrNoServersAvailable is returned when no candidate server could be measured
+	ErrNoServersAvailable = errors.New("no servers available")
+	// ErrServerNotFound is returned when a server ID is not in the server list
+	ErrServerNotFound = errors.New("server not found")
+	// ErrServerNotAllowed is returned when a server ID is left out of the config's Allowlist
+	ErrServerNotAllowed = errors.New("server not in the allowlist")
+)
+
+// HTTPStatusError is returned when speedtest.net or a test server answers
+// with a status other than 200 OK
+type HTTPStatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s from %s", e.StatusCode, http.StatusText(e.StatusCode), e.URL)
+}
+
+// ParseError is returned when a config XML attribute holds a value that cannot be parsed
+type ParseError struct {
+	// Field names the attribute, such as "client lat" or "upload maxchunksize"
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cannot parse %s %q: %v", e.Field, e.Value, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// statusError returns an HTTPStatusError for resp unless it is 200 OK
+func statusError(resp *http.Response) error {
+	if checkHTTP(resp) {
+		return nil
+	}
+	return &HTTPStatusError{StatusCode: resp.StatusCode, URL: resp.Request.URL.String()}
+}
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPStatusError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	stClient := &Client{
+		SpeedtestConfig: &SpeedtestConfig{ConfigURL: ts.URL + "/config", ServersURL: ts.URL + "/servers"},
+		Timeout:         15 * time.Second,
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		call func() error
+	}{
+		{name: "config", url: ts.URL + "/config", call: func() error { _, err := stClient.GetConfig(); return err }},
+		{name: "servers", url: ts.URL + "/servers", call: func() error { _, err := stClient.GetServers(); return err }},
+		{name: "download", url: ts.URL + "/random350x350.jpg", call: func() error {
+			_, err := stClient.DownloadContext(context.Background(), ts.URL+"/random350x350.jpg", &strings.Builder{})
+			return err
+		}},
+		{name: "upload", url: ts.URL + "/upload.php", call: func() error {
+			_, err := stClient.UploadContext(context.Background(), ts.URL+"/upload.php", "text/xml", strings.NewReader("abc"), nil)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var statusErr *HTTPStatusError
+			if err := tt.call(); !errors.As(err, &statusErr) {
+				t.Fatalf("error = %v, want a *HTTPStatusError", err)
+			}
+			if statusErr.StatusCode != http.StatusServiceUnavailable || statusErr.URL != tt.url {
+				t.Errorf("HTTPStatusError = %+v, want status %d from %s", statusErr, http.StatusServiceUnavailable, tt.url)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name      string
+		parse     func() error
+		wantField string
+		wantValue string
+	}{
+		{
+			name: "config lat",
+			parse: func() error {
+				_, err := ParseConfig(strings.NewReader(`<settings><client lat="north" lon="1"/></settings>`))
+				return err
+			},
+			wantField: "client lat",
+			wantValue: "north",
+		},
+		{
+			name: "config maxchunksize",
+			parse: func() error {
+				_, err := ParseConfig(strings.NewReader(`<settings><client lat="1" lon="1"/><upload maxchunksize="lots"/></settings>`))
+				return err
+			},
+			wantField: "upload maxchunksize",
+			wantValue: "lots",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parseErr *ParseError
+			err := tt.parse()
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("error = %v, want a *ParseError", err)
+			}
+			if parseErr.Field != tt.wantField || parseErr.Value != tt.wantValue {
+				t.Errorf("ParseError = %+v, want field %q value %q", parseErr, tt.wantField, tt.wantValue)
+			}
+			if !errors.Is(err, strconv.ErrSyntax) {
+				t.Errorf("ParseError does not wrap strconv.ErrSyntax: %v", err)
+			}
+		})
+	}
+}
+
+func TestClient_GetFastestServerNoServers(t *testing.T) {
+	stClient := &Client{SpeedtestConfig: &SpeedtestConfig{}, Timeout: 15 * time.Second}
+	if _, err := stClient.GetFastestServer(nil); !errors.Is(err, ErrNoServersAvailable) {
+		t.Errorf("Client.GetFastestServer() error = %v, want %v", err, ErrNoServersAvailable)
+	}
+}
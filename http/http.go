@@ -2,15 +2,21 @@ package http
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kylegrantlucas/speedtest/coords"
@@ -20,11 +26,32 @@ import (
 const max = "max"
 
 // Config struct holds our config (users current ip, lat, lon and isp)
+// along with the test settings advertised by speedtest.net
 type Config struct {
 	IP  string
 	Lat float64
 	Lon float64
 	Isp string
+
+	// ThreadCount is the number of concurrent connections to test with
+	ThreadCount int
+	// IgnoreIDs lists the servers speedtest.net says not to test against
+	IgnoreIDs []string
+	// DownloadThreadsPerURL is how many times each download URL is fetched
+	DownloadThreadsPerURL int
+	// DownloadTestLength is how long a duration-bounded download test runs
+	DownloadTestLength time.Duration
+
+	// UploadThreads is the number of concurrent connections to upload with
+	UploadThreads int
+	// UploadRatio picks the smallest upload size used, counting from 1
+	UploadRatio int
+	// UploadMaxChunkSize caps the size in bytes of a single upload
+	UploadMaxChunkSize int
+	// UploadMaxChunkCount is the total number of uploads to perform
+	UploadMaxChunkCount int
+	// UploadTestLength is how long a duration-bounded upload test runs
+	UploadTestLength time.Duration
 }
 
 // Client define a Speedtest HTTP client
@@ -33,16 +60,87 @@ type Client struct {
 	SpeedtestConfig *SpeedtestConfig
 	Timeout         time.Duration
 	ReportChar      string
+
+	// Servers, when not nil, is the server list GetServers returns in
+	// place of fetching ServersURL
+	Servers []Server
+	// Logger receives debug events for each request and warnings such as
+	// failures to close a body, NopLogger when nil
+	Logger Logger
+
+	// transport is shared by every request so connections are reused
+	// across the config, servers, latency, download and upload phases.
+	// transportMu guards it, as CloseIdleConnections may run alongside
+	// the first request building it.
+	transport    *http.Transport
+	transportErr error
+	transportMu  sync.Mutex
 }
 
 type SpeedtestConfig struct {
-	ConfigURL       string
-	ServersURL      string
+	ConfigURL  string
+	ServersURL string
+	// ConfigFile, when set, loads the config from a saved speedtest-config.php
+	// response instead of fetching ConfigURL
+	ConfigFile string
+	// ServersFile, when set, loads the server list from a saved
+	// speedtest-servers-static.php response instead of fetching ServersURL
+	ServersFile string
+	// ServerCache, when set, keeps the server list fetched from ServersURL
+	// between calls, revalidating it once it is older than ServerCacheTTL
+	// and falling back to it when a fresh list cannot be fetched
+	ServerCache ServerCache
+	// ServerCacheTTL is how long a cached list is used as is, DefaultServerCacheTTL when 0
+	ServerCacheTTL  time.Duration
 	AlgoType        string
 	NumClosest      int
 	NumLatencyTests int
-	Interface       string
-	UserAgent       string
+	// Interface binds every request to a network interface name or source IP address
+	Interface string
+	UserAgent string
+	// Blacklist lists server IDs to exclude on top of the config's ignoreids
+	Blacklist []string
+	// Allowlist, when not empty, restricts server selection to these server IDs
+	Allowlist []string
+
+	// FreshConnections disables keep-alives so every request pays for a
+	// new connection, for cold-start measurements
+	FreshConnections bool
+	// MaxIdleConns caps the idle connections kept across all servers, 0 means no limit
+	MaxIdleConns int
+	// MaxIdleConnsPerHost caps the idle connections kept per server,
+	// http.DefaultMaxIdleConnsPerHost when 0
+	MaxIdleConnsPerHost int
+	// DisableHTTP2 keeps HTTPS servers on HTTP/1.1
+	DisableHTTP2 bool
+	// Proxy picks the proxy for each request, http.ProxyFromEnvironment when nil
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Transport, when set, replaces the transport built from the settings
+	// above, which are then ignored
+	Transport http.RoundTripper
+	// HTTPClient, when set, makes every request in place of a client built
+	// around Transport and the client timeout
+	HTTPClient Doer
+
+	// ProbeWorkers is how many servers are probed at once when ranking them,
+	// DefaultProbeWorkers when 0
+	ProbeWorkers int
+	// ProbeTimeout bounds measuring each server's latency when non-zero
+	ProbeTimeout time.Duration
+
+	// Retry, when set, retries requests failing with a network error or a
+	// retryable status
+	Retry *RetryPolicy
+
+	// Logger is the Logger of clients created from this config, so even
+	// the config fetch in NewClient is logged
+	Logger Logger
+}
+
+// Doer sends HTTP requests, as *http.Client does
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
 }
 
 // NewClient define a new Speedtest client.
@@ -51,6 +149,7 @@ func NewClient(speedtestConfig *SpeedtestConfig, timeout time.Duration) (*Client
 		Config:          nil,
 		Timeout:         timeout,
 		SpeedtestConfig: speedtestConfig,
+		Logger:          speedtestConfig.Logger,
 	}
 
 	config, err := client.GetConfig()
@@ -59,21 +158,47 @@ func NewClient(speedtestConfig *SpeedtestConfig, timeout time.Duration) (*Client
 	}
 
 	client.Config = &config
+	client.logger().Debug("loaded config", "ip", config.IP, "isp", config.Isp, "threads", config.ThreadCount)
+	return client, nil
+}
+
+// NewClientFromReaders creates a client from config and servers XML already
+// at hand, so finding a server makes no requests to speedtest.net
+func NewClientFromReaders(speedtestConfig *SpeedtestConfig, config io.Reader, servers io.Reader, timeout time.Duration) (*Client, error) {
+	client := &Client{
+		Config:          nil,
+		Timeout:         timeout,
+		SpeedtestConfig: speedtestConfig,
+		Logger:          speedtestConfig.Logger,
+	}
+
+	c, err := ParseConfig(config)
+	if err != nil {
+		return client, err
+	}
+	client.Config = &c
+
+	client.Servers, err = parseServers(servers, client.logger())
+	if err != nil {
+		return client, err
+	}
 	return client, nil
 }
 
 // Server struct is a speedtest candidate server
 type Server struct {
-	URL      string
-	Lat      float64
-	Lon      float64
-	Name     string
-	Country  string
-	CC       string
-	Sponsor  string
-	ID       string
-	Distance float64
-	Latency  float64
+	URL      string  `json:"url"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	Name     string  `json:"name"`
+	Country  string  `json:"country"`
+	CC       string  `json:"cc"`
+	Sponsor  string  `json:"sponsor"`
+	ID       string  `json:"id"`
+	Distance float64 `json:"distance_km"`
+	Latency  float64 `json:"latency_ms"`
+	// LatencyReport holds every probe behind Latency once the server has been measured
+	LatencyReport *LatencyReport `json:"latency_report,omitempty"`
 }
 
 // ByDistance allows us to sort servers by distance
@@ -117,128 +242,390 @@ func checkHTTP(resp *http.Response) bool {
 	return ok
 }
 
+// contextError prefers the context's error over err once the context has
+// been cancelled or its deadline has passed
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
 // GetConfig downloads the master config from speedtest.net
 func (stClient *Client) GetConfig() (c Config, err error) {
-	c = Config{}
+	return stClient.GetConfigContext(context.Background())
+}
 
-	client := &http.Client{
-		Timeout: stClient.Timeout,
-	}
+// GetConfigContext downloads the master config from speedtest.net, aborting when ctx is done
+func (stClient *Client) GetConfigContext(ctx context.Context) (c Config, err error) {
+	c = Config{}
 
-	req, err := http.NewRequest("GET", stClient.SpeedtestConfig.ConfigURL, nil)
-	if err != nil {
-		return c, err
+	if stClient.SpeedtestConfig.ConfigFile != "" {
+		stClient.logger().Debug("loading config", "file", stClient.SpeedtestConfig.ConfigFile)
+		return ReadConfigFile(stClient.SpeedtestConfig.ConfigFile)
 	}
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("User-Agent", stClient.SpeedtestConfig.UserAgent)
 
-	resp, err := client.Do(req)
+	stClient.logger().Debug("fetching config", "url", stClient.SpeedtestConfig.ConfigURL)
+	resp, err := stClient.do(ctx, func() (*http.Request, error) {
+		return stClient.newRequest(ctx, "GET", stClient.SpeedtestConfig.ConfigURL, nil)
+	})
 	if err != nil {
 		return c, err
 	}
 
 	defer func() {
-		err = resp.Body.Close()
-		if err != nil {
-			log.Printf("error closing body of config request: %v", err)
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			stClient.logger().Warn("error closing body of config request", "error", closeErr)
 		}
 	}()
 
-	if !checkHTTP(resp) {
-		return c, errors.New("couldn't connect to speedtest to get config")
+	if err := statusError(resp); err != nil {
+		return c, err
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return c, err
+		return c, contextError(ctx, err)
+	}
+
+	return ParseConfig(bytes.NewReader(body))
+}
+
+// ReadConfigFile loads a config saved from speedtest-config.php
+func ReadConfigFile(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
 	}
+	defer f.Close()
+
+	return ParseConfig(f)
+}
 
+// ParseConfig parses config XML in the speedtest-config.php format. A
+// malformed attribute is reported as a *ParseError.
+func ParseConfig(r io.Reader) (c Config, err error) {
 	cx := new(stxml.XMLConfigSettings)
 
-	err = xml.Unmarshal(body, &cx)
+	err = xml.NewDecoder(r).Decode(&cx)
 	if err != nil {
 		return c, err
 	}
 
 	c.IP = cx.Client.IP
-	c.Lat, err = strconv.ParseFloat(cx.Client.Lat, 64)
-	if err != nil {
-		return c, err
+	c.Isp = cx.Client.Isp
+	c.IgnoreIDs = parseList(cx.ServerConfig.IgnoreIDs)
+
+	if c.Lat, err = strconv.ParseFloat(cx.Client.Lat, 64); err != nil {
+		return c, parseError("client lat", cx.Client.Lat, err)
+	}
+	if c.Lon, err = strconv.ParseFloat(cx.Client.Lon, 64); err != nil {
+		return c, parseError("client lon", cx.Client.Lon, err)
+	}
+	if c.ThreadCount, err = parseInt(cx.ServerConfig.ThreadCount); err != nil {
+		return c, parseError("server-config threadcount", cx.ServerConfig.ThreadCount, err)
+	}
+	if c.DownloadThreadsPerURL, err = parseInt(cx.Download.ThreadsPerURL); err != nil {
+		return c, parseError("download threadsperurl", cx.Download.ThreadsPerURL, err)
+	}
+	if c.DownloadTestLength, err = parseSeconds(cx.Download.TestLength); err != nil {
+		return c, parseError("download testlength", cx.Download.TestLength, err)
+	}
+	if c.UploadTestLength, err = parseSeconds(cx.Upload.TestLength); err != nil {
+		return c, parseError("upload testlength", cx.Upload.TestLength, err)
+	}
+	if c.UploadThreads, err = parseInt(cx.Upload.Threads); err != nil {
+		return c, parseError("upload threads", cx.Upload.Threads, err)
+	}
+	if c.UploadRatio, err = parseInt(cx.Upload.Ratio); err != nil {
+		return c, parseError("upload ratio", cx.Upload.Ratio, err)
+	}
+	if c.UploadMaxChunkSize, err = parseSize(cx.Upload.MaxChunkSize); err != nil {
+		return c, parseError("upload maxchunksize", cx.Upload.MaxChunkSize, err)
+	}
+	if c.UploadMaxChunkCount, err = parseInt(cx.Upload.MaxChunkCount); err != nil {
+		return c, parseError("upload maxchunkcount", cx.Upload.MaxChunkCount, err)
 	}
 
-	c.Lon, err = strconv.ParseFloat(cx.Client.Lon, 64)
-	if err != nil {
-		return c, err
+	return c, nil
+}
+
+// parseError wraps a strconv failure to parse value as a *ParseError for field
+func parseError(field, value string, err error) error {
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		err = numErr.Err
 	}
+	return &ParseError{Field: field, Value: value, Err: err}
+}
 
-	c.Isp = cx.Client.Isp
+// parseInt parses an optional integer attribute, treating a missing one as 0
+func parseInt(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// parseList splits an optional comma separated attribute
+func parseList(s string) []string {
+	var list []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			list = append(list, field)
+		}
+	}
+	return list
+}
 
-	return c, err
+// parseSeconds parses an optional attribute holding a number of seconds
+func parseSeconds(s string) (time.Duration, error) {
+	n, err := parseInt(s)
+	return time.Duration(n) * time.Second, err
+}
+
+// parseSize parses an optional size attribute such as "512K" or "1M" into bytes
+func parseSize(s string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1024
+		s = strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1024 * 1024
+		s = strings.TrimSuffix(s, "M")
+	}
+
+	n, err := parseInt(s)
+	return n * multiplier, err
 }
 
 // GetServers will get the full server list
 func (stClient *Client) GetServers() (servers []Server, err error) {
-	client := &http.Client{
-		Timeout: stClient.Timeout,
-	}
+	return stClient.GetServersContext(context.Background())
+}
 
-	req, err := http.NewRequest("GET", stClient.SpeedtestConfig.ServersURL, nil)
+// GetServersContext will get the full server list, aborting when ctx is done
+func (stClient *Client) GetServersContext(ctx context.Context) (servers []Server, err error) {
+	switch {
+	case stClient.Servers != nil:
+		servers = stClient.Servers
+	case stClient.SpeedtestConfig.ServersFile != "":
+		servers, err = readServersFile(stClient.SpeedtestConfig.ServersFile, stClient.logger())
+	case stClient.SpeedtestConfig.ServerCache != nil:
+		servers, err = stClient.cachedServers(ctx)
+	default:
+		var fetched CachedServers
+		fetched, err = stClient.fetchServers(ctx, nil)
+		servers = fetched.Servers
+	}
 	if err != nil {
 		return []Server{}, err
 	}
 
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("User-Agent", stClient.SpeedtestConfig.UserAgent)
+	servers = stClient.withoutIgnored(servers)
+	stClient.logger().Debug("loaded server list", "servers", len(servers))
+	return servers, nil
+}
+
+// cachedServers returns the cached server list while it is younger than the
+// TTL, revalidates it once it is older, and falls back to it when fetching a
+// fresh list fails
+func (stClient *Client) cachedServers(ctx context.Context) ([]Server, error) {
+	cache := stClient.SpeedtestConfig.ServerCache
+
+	cached, ok, err := cache.Load()
+	if err != nil {
+		stClient.logger().Warn("error loading cached server list", "error", err)
+		ok = false
+	}
+	if ok && !sameServersURL(cached.URL, stClient.SpeedtestConfig.ServersURL) {
+		ok = false
+	}
+
+	ttl := stClient.SpeedtestConfig.ServerCacheTTL
+	if ttl <= 0 {
+		ttl = DefaultServerCacheTTL
+	}
+	if ok && time.Since(cached.Fetched) < ttl {
+		stClient.logger().Debug("using cached server list", "fetched", cached.Fetched)
+		return cached.Servers, nil
+	}
+
+	var prior *CachedServers
+	if ok {
+		prior = &cached
+	}
 
-	resp, err := client.Do(req)
+	fetched, err := stClient.fetchServers(ctx, prior)
 	if err != nil {
-		return []Server{}, err
+		if ok && ctx.Err() == nil {
+			stClient.logger().Warn("error fetching server list, using the cached one", "fetched", cached.Fetched, "error", err)
+			return cached.Servers, nil
+		}
+		return nil, err
+	}
+
+	if err := cache.Store(fetched); err != nil {
+		stClient.logger().Warn("error caching server list", "error", err)
+	}
+	return fetched.Servers, nil
+}
+
+// fetchServers downloads the server list from ServersURL. When prior is set
+// the request is conditional on its validators, and prior is returned with
+// a new fetch time if the server reports it has not changed.
+func (stClient *Client) fetchServers(ctx context.Context, prior *CachedServers) (CachedServers, error) {
+	fetched := CachedServers{URL: stClient.SpeedtestConfig.ServersURL}
+
+	stClient.logger().Debug("fetching server list", "url", stClient.SpeedtestConfig.ServersURL, "revalidating", prior != nil)
+	resp, err := stClient.do(ctx, func() (*http.Request, error) {
+		req, err := stClient.newRequest(ctx, "GET", stClient.SpeedtestConfig.ServersURL, nil)
+		if err != nil || prior == nil {
+			return req, err
+		}
+		if prior.ETag != "" {
+			req.Header.Set("If-None-Match", prior.ETag)
+		}
+		if prior.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prior.LastModified)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return fetched, err
 	}
 
 	defer func() {
-		err = resp.Body.Close()
-		if err != nil {
-			log.Printf("error closing body of servers request: %v", err)
+		if err := resp.Body.Close(); err != nil {
+			stClient.logger().Warn("error closing body of servers request", "error", err)
 		}
 	}()
 
+	if prior != nil && resp.StatusCode == http.StatusNotModified {
+		revalidated := *prior
+		revalidated.Fetched = time.Now()
+		return revalidated, nil
+	}
+	if err := statusError(resp); err != nil {
+		return fetched, err
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fetched, contextError(ctx, err)
+	}
+
+	fetched.Servers, err = parseServers(bytes.NewReader(body), stClient.logger())
+	if err != nil {
+		return fetched, err
+	}
+	fetched.Fetched = time.Now()
+	fetched.ETag = resp.Header.Get("ETag")
+	fetched.LastModified = resp.Header.Get("Last-Modified")
+	return fetched, nil
+}
+
+// ReadServersFile loads a server list saved from speedtest-servers-static.php
+func ReadServersFile(path string) ([]Server, error) {
+	return readServersFile(path, NopLogger)
+}
+
+func readServersFile(path string, logger Logger) ([]Server, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return []Server{}, err
 	}
+	defer f.Close()
 
+	return parseServers(f, logger)
+}
+
+// ParseServers parses servers XML in the speedtest-servers-static.php
+// format. A server with malformed coordinates is kept with zero coordinates,
+// as one bad entry should not cost the rest of the list.
+func ParseServers(r io.Reader) ([]Server, error) {
+	return parseServers(r, NopLogger)
+}
+
+// parseServers is ParseServers, warning logger about malformed coordinates
+func parseServers(r io.Reader, logger Logger) (servers []Server, err error) {
 	s := new(stxml.ServerSettings)
 
-	err = xml.Unmarshal(body, &s)
+	err = xml.NewDecoder(r).Decode(&s)
 	if err != nil {
 		return []Server{}, err
 	}
 
-	for xmlServer := range s.ServersContainer.XMLServers {
-		var err error
-		server := new(Server)
-		server.URL = s.ServersContainer.XMLServers[xmlServer].URL
-		server.Lat, err = strconv.ParseFloat(s.ServersContainer.XMLServers[xmlServer].Lat, 64)
-		if err != nil {
-			log.Printf("error parsing lat: %v", err)
+	for _, xmlServer := range s.ServersContainer.XMLServers {
+		server := Server{
+			URL:     xmlServer.URL,
+			Name:    xmlServer.Name,
+			Country: xmlServer.Country,
+			CC:      xmlServer.CC,
+			Sponsor: xmlServer.Sponsor,
+			ID:      xmlServer.ID,
 		}
-		server.Lon, err = strconv.ParseFloat(s.ServersContainer.XMLServers[xmlServer].Lon, 64)
-		if err != nil {
-			log.Printf("error parsing lon: %v", err)
+		if server.Lat, err = strconv.ParseFloat(xmlServer.Lat, 64); err != nil {
+			logger.Warn("error parsing server lat", "server", server.ID, "value", xmlServer.Lat, "error", err)
+			server.Lat = 0
 		}
-
-		server.Name = s.ServersContainer.XMLServers[xmlServer].Name
-		server.Country = s.ServersContainer.XMLServers[xmlServer].Country
-		server.CC = s.ServersContainer.XMLServers[xmlServer].CC
-		server.Sponsor = s.ServersContainer.XMLServers[xmlServer].Sponsor
-		server.ID = s.ServersContainer.XMLServers[xmlServer].ID
-		servers = append(servers, *server)
+		if server.Lon, err = strconv.ParseFloat(xmlServer.Lon, 64); err != nil {
+			logger.Warn("error parsing server lon", "server", server.ID, "value", xmlServer.Lon, "error", err)
+			server.Lon = 0
+		}
+		servers = append(servers, server)
 	}
 	return servers, nil
 }
 
-// GetClosestServers takes the full server list and sorts by distance
+// Ignored reports whether the server with id is in the config's ignoreids or the blacklist
+func (stClient *Client) Ignored(id string) bool {
+	if stClient.Config != nil {
+		for _, ignored := range stClient.Config.IgnoreIDs {
+			if ignored == id {
+				return true
+			}
+		}
+	}
+	if stClient.SpeedtestConfig != nil {
+		for _, blacklisted := range stClient.SpeedtestConfig.Blacklist {
+			if blacklisted == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Allowed reports whether the server with id may be selected under the allowlist
+func (stClient *Client) Allowed(id string) bool {
+	if stClient.SpeedtestConfig == nil || len(stClient.SpeedtestConfig.Allowlist) == 0 {
+		return true
+	}
+	for _, allowed := range stClient.SpeedtestConfig.Allowlist {
+		if allowed == id {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutIgnored returns the servers that are not Ignored
+func (stClient *Client) withoutIgnored(servers []Server) []Server {
+	var kept []Server
+	for _, server := range servers {
+		if !stClient.Ignored(server.ID) {
+			kept = append(kept, server)
+		}
+	}
+	return kept
+}
+
+// GetClosestServers takes the full server list, drops ignored servers and sorts by distance
 func (stClient *Client) GetClosestServers(servers []Server) []Server {
+	servers = stClient.withoutIgnored(servers)
+
 	myCoords := coords.Coordinate{
 		Lat: stClient.Config.Lat,
 		Lon: stClient.Config.Lon,
@@ -268,202 +655,359 @@ func (stClient *Client) GetLatencyURL(server Server) string {
 
 // GetLatency will test the latency (ping) the given server NUMLATENCYTESTS times and return either the lowest or average depending on what algorithm is set
 func (stClient *Client) GetLatency(url string) (result float64, err error) {
-	var latency time.Duration
-	var minLatency time.Duration
-	var avgLatency time.Duration
-
-	for i := 0; i < stClient.SpeedtestConfig.NumLatencyTests; i++ {
-		var failed bool
-		var finish time.Time
-
-		start := time.Now()
-
-		client, err := stClient.getHTTPClient()
-		if err != nil {
-			return result, err
-		}
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return 0, err
-		}
-
-		req.Header.Set("Cache-Control", "no-cache")
-		req.Header.Set("User-Agent", stClient.SpeedtestConfig.UserAgent)
+	return stClient.GetLatencyContext(context.Background(), url)
+}
 
-		resp, err := client.Do(req)
+// GetLatencyContext is GetLatency, aborting between and during probes when ctx is done
+func (stClient *Client) GetLatencyContext(ctx context.Context, url string) (result float64, err error) {
+	samples, err := stClient.GetLatencySamplesContext(ctx, url)
+	if err != nil {
+		return result, err
+	}
 
-		if err != nil {
-			return result, err
-		}
+	return stClient.reduceLatency(samples), nil
+}
 
-		defer func() {
-			err = resp.Body.Close()
-			if err != nil {
-				log.Printf("error closing body of latency request: %v", err)
-			}
-		}()
+// GetLatencySamplesContext probes the given url NUMLATENCYTESTS times and returns every successful latency in milliseconds
+func (stClient *Client) GetLatencySamplesContext(ctx context.Context, url string) (samples []float64, err error) {
+	report, err := stClient.GetLatencyReportContext(ctx, url)
+	return report.Samples, err
+}
 
-		finish = time.Now()
-		_, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return result, err
-		}
+// reduceLatency returns either the lowest or average of samples depending on what algorithm is set
+func (stClient *Client) reduceLatency(samples []float64) float64 {
+	var minLatency float64
+	var avgLatency float64
 
-		if failed {
-			latency = 1 * time.Minute
-		} else {
-			latency = finish.Sub(start)
-		}
+	if len(samples) == 0 {
+		return 0
+	}
 
-		if stClient.SpeedtestConfig.AlgoType == max {
-			if minLatency == 0 {
-				minLatency = latency
-			} else if latency < minLatency {
-				minLatency = latency
-			}
-		} else {
-			avgLatency = avgLatency + latency
+	for i, latency := range samples {
+		if i == 0 || latency < minLatency {
+			minLatency = latency
 		}
-
+		avgLatency = avgLatency + latency
 	}
 
 	if stClient.SpeedtestConfig.AlgoType == max {
-		result = float64(time.Duration(minLatency.Nanoseconds())*time.Nanosecond) / 1000000
-	} else {
-		result = float64(time.Duration(avgLatency.Nanoseconds())*time.Nanosecond) / 1000000 / float64(stClient.SpeedtestConfig.NumLatencyTests)
+		return minLatency
 	}
-
-	return result, nil
-
+	return avgLatency / float64(len(samples))
 }
 
-// GetFastestServer test all servers until we find numServers that
-// respond, then find the fastest of them.  Some servers show up in the
-// master list but timeout or are "corrupt" therefore we bump their
-// latency to something really high (1 minute) and they will drop out of
-// this test
+// GetFastestServer probes the closest servers and returns the one with the
+// lowest latency, see RankServersContext
 func (stClient *Client) GetFastestServer(servers []Server) (Server, error) {
-	var successfulServers []Server
-
-	for server := range servers {
-		latency, err := stClient.GetLatency(stClient.GetLatencyURL(servers[server]))
-
-		if err != nil {
-			return Server{}, err
-		}
-
-		if latency < float64(1*time.Minute) {
-			successfulServers = append(successfulServers, servers[server])
-			successfulServers[server].Latency = latency
-		}
-
-		if len(successfulServers) == stClient.SpeedtestConfig.NumClosest {
-			break
-		}
-	}
-
-	sort.Sort(ByLatency(successfulServers))
+	return stClient.GetFastestServerContext(context.Background(), servers)
+}
 
-	if len(successfulServers) == 0 {
-		return Server{}, errors.New("no servers available")
+// GetFastestServerContext is GetFastestServer, aborting when ctx is done
+func (stClient *Client) GetFastestServerContext(ctx context.Context, servers []Server) (Server, error) {
+	ranked, err := stClient.RankServersContext(ctx, servers)
+	if err != nil {
+		return Server{}, err
 	}
 
-	return successfulServers[0], nil
+	return ranked[0], nil
 }
 
 // DownloadSpeed measures the mbps of downloading a URL
 func (stClient *Client) DownloadSpeed(url string) (speed float64, err error) {
+	return stClient.DownloadSpeedContext(context.Background(), url)
+}
+
+// DownloadSpeedContext measures the mbps of downloading a URL, aborting when ctx is done
+func (stClient *Client) DownloadSpeedContext(ctx context.Context, url string) (speed float64, err error) {
 	start := time.Now()
 
-	client, err := stClient.getHTTPClient()
+	bodyLen, err := stClient.DownloadContext(ctx, url, ioutil.Discard)
 	if err != nil {
 		return 0, err
 	}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return 0, err
-	}
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("User-Agent", stClient.SpeedtestConfig.UserAgent)
+	finish := time.Now()
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return 0, err
-	}
+	bits := float64(bodyLen * 8)
+	megabits := bits / float64(1000) / float64(1000)
+	seconds := finish.Sub(start).Seconds()
+	mbps := megabits / seconds
 
-	body, err := ioutil.ReadAll(resp.Body)
+	return mbps, err
+}
+
+// DownloadContext streams the body of url into w and returns the number of bytes read
+func (stClient *Client) DownloadContext(ctx context.Context, url string, w io.Writer) (n int64, err error) {
+	resp, err := stClient.do(ctx, func() (*http.Request, error) {
+		return stClient.newRequest(ctx, "GET", url, nil)
+	})
 	if err != nil {
 		return 0, err
 	}
-	finish := time.Now()
-	bodyLen := len(body)
 
 	defer func() {
-		err = resp.Body.Close()
-		if err != nil {
-			log.Printf("error closing body of download request: %v", err)
+		closeErr := resp.Body.Close()
+		if closeErr != nil {
+			stClient.logger().Warn("error closing body of download request", "url", url, "error", closeErr)
 		}
 	}()
 
-	bits := float64(bodyLen * 8)
-	megabits := bits / float64(1000) / float64(1000)
-	seconds := finish.Sub(start).Seconds()
-	mbps := megabits / seconds
+	if err := statusError(resp); err != nil {
+		return 0, err
+	}
 
-	return mbps, err
+	n, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return n, contextError(ctx, err)
+	}
+
+	return n, nil
 }
 
 // UploadSpeed measures the mbps to http.Post to a URL
 func (stClient *Client) UploadSpeed(url string, mimetype string, data []byte) (speed float64, err error) {
-	buf := bytes.NewBuffer(data)
+	return stClient.UploadSpeedContext(context.Background(), url, mimetype, data)
+}
+
+// UploadSpeedContext measures the mbps to http.Post to a URL, aborting when ctx is done
+func (stClient *Client) UploadSpeedContext(ctx context.Context, url string, mimetype string, data []byte) (speed float64, err error) {
 	start := time.Now()
 
-	client, err := stClient.getHTTPClient()
+	_, err = stClient.UploadContext(ctx, url, mimetype, bytes.NewReader(data), nil)
+	finish := time.Now()
 	if err != nil {
 		return 0, err
 	}
-	resp, err := client.Post(url, mimetype, buf)
-	finish := time.Now()
+
+	bits := float64(len(data) * 8)
+	megabits := bits / float64(1000) / float64(1000)
+	seconds := finish.Sub(start).Seconds()
+
+	mbps := megabits / seconds
+	return mbps, nil
+}
+
+// UploadContext posts body to url and returns the number of bytes read from
+// body, copying each chunk read to progress when it is not nil. Pass a
+// *bytes.Buffer, *bytes.Reader or *strings.Reader body so the request has a
+// Content-Length and can be replayed, as only uploads of those are retried.
+func (stClient *Client) UploadContext(ctx context.Context, url string, mimetype string, body io.Reader, progress io.Writer) (n int64, err error) {
+	req, err := stClient.newRequest(ctx, "POST", url, body)
 	if err != nil {
 		return 0, err
 	}
+	req.Header.Set("Content-Type", mimetype)
+
+	counter := &countingReader{progress: progress}
+	resp, err := stClient.do(ctx, func() (*http.Request, error) {
+		return countBody(req, counter)
+	})
+	if err != nil {
+		return counter.n, err
+	}
 
 	defer func() {
-		err = resp.Body.Close()
-		if err != nil {
-			log.Printf("error closing body of upload request: %v", err)
+		closeErr := resp.Body.Close()
+		if closeErr != nil {
+			stClient.logger().Warn("error closing body of upload request", "url", url, "error", closeErr)
 		}
 	}()
 
 	_, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return 0, err
+		return counter.n, contextError(ctx, err)
+	}
+	if err := statusError(resp); err != nil {
+		return counter.n, err
 	}
 
-	bits := float64(len(data) * 8)
-	megabits := bits / float64(1000) / float64(1000)
-	seconds := finish.Sub(start).Seconds()
+	return counter.n, nil
+}
 
-	mbps := megabits / seconds
-	return mbps, nil
+// countingReader counts the bytes read through it, copying them to progress when set
+type countingReader struct {
+	io.Reader
+	n        int64
+	progress io.Writer
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	if r.progress != nil && n > 0 {
+		r.progress.Write(p[:n])
+	}
+	return n, err
 }
 
-func (stClient *Client) getHTTPClient() (*http.Client, error) {
+// countBody returns a copy of req reading its body through counter, which
+// starts over from zero. When req.GetBody is set the copy gets a fresh body
+// from it, and a GetBody of its own that counts the replayed body instead.
+func countBody(req *http.Request, counter *countingReader) (*http.Request, error) {
+	counted := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return counted, nil
+	}
+
+	count := func(body io.ReadCloser) io.ReadCloser {
+		counter.Reader, counter.n = body, 0
+		return struct {
+			io.Reader
+			io.Closer
+		}{counter, body}
+	}
+
+	if req.GetBody == nil {
+		counted.Body = count(req.Body)
+		return counted, nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	counted.Body = count(body)
+	counted.GetBody = func() (io.ReadCloser, error) {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		return count(body), nil
+	}
+	return counted, nil
+}
+
+// getHTTPClient returns the client to make a single request with: the
+// configured HTTPClient or Transport when there is one, otherwise a client
+// sharing the transport built from the SpeedtestConfig on first use, so
+// changes to its transport settings after that have no effect.
+func (stClient *Client) getHTTPClient() (Doer, error) {
+	if stClient.SpeedtestConfig.HTTPClient != nil {
+		return stClient.SpeedtestConfig.HTTPClient, nil
+	}
+	if stClient.SpeedtestConfig.Transport != nil {
+		return &http.Client{
+			Timeout:   stClient.Timeout,
+			Transport: stClient.SpeedtestConfig.Transport,
+		}, nil
+	}
+
+	stClient.transportMu.Lock()
+	if stClient.transport == nil && stClient.transportErr == nil {
+		stClient.transport, stClient.transportErr = stClient.newTransport()
+	}
+	transport, err := stClient.transport, stClient.transportErr
+	stClient.transportMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Timeout:   stClient.Timeout,
+		Transport: transport,
+	}
+
+	return client, nil
+}
+
+// newTransport builds a transport from the SpeedtestConfig, bound to the
+// configured Interface when there is one
+func (stClient *Client) newTransport() (*http.Transport, error) {
+	config := stClient.SpeedtestConfig
+
+	laddr, err := localAddr(config.Interface)
+	if err != nil {
+		return nil, err
+	}
+
 	dialer := net.Dialer{
 		Timeout:   stClient.Timeout,
 		KeepAlive: stClient.Timeout,
+		LocalAddr: laddr,
+	}
+
+	proxy := config.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
 	}
 
 	transport := &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
-		Dial:                dialer.Dial,
+		Proxy:               proxy,
+		DialContext:         dialer.DialContext,
 		TLSHandshakeTimeout: stClient.Timeout,
+		DisableKeepAlives:   config.FreshConnections,
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   !config.DisableHTTP2,
+	}
+	if config.DisableHTTP2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
 	}
 
-	client := &http.Client{
-		Timeout:   stClient.Timeout,
-		Transport: transport,
+	return transport, nil
+}
+
+// CloseIdleConnections closes the idle connections kept open for reuse,
+// including those of a configured HTTPClient or Transport that supports it
+func (stClient *Client) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
 	}
 
-	return client, nil
+	stClient.transportMu.Lock()
+	transport := stClient.transport
+	stClient.transportMu.Unlock()
+
+	if transport != nil {
+		transport.CloseIdleConnections()
+	}
+	if c, ok := stClient.SpeedtestConfig.HTTPClient.(closeIdler); ok {
+		c.CloseIdleConnections()
+	}
+	if c, ok := stClient.SpeedtestConfig.Transport.(closeIdler); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// localAddr resolves iface, either a network interface name or a source
+// IP address, to the local address requests should originate from. An
+// empty iface leaves the choice to the operating system.
+func localAddr(iface string) (net.Addr, error) {
+	if iface == "" {
+		return nil, nil
+	}
+
+	if ip := net.ParseIP(iface); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+
+	netInterface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use interface %q: %v", iface, err)
+	}
+
+	addrs, err := netInterface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list addresses of interface %q: %v", iface, err)
+	}
+
+	// prefer IPv4 since speedtest servers are mostly reachable over it
+	var ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+		if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+	if ipv6 != nil {
+		return &net.TCPAddr{IP: ipv6}, nil
+	}
+
+	return nil, fmt.Errorf("interface %q has no usable address", iface)
 }
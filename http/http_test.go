@@ -1,21 +1,28 @@
 package http
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	stxml "github.com/kylegrantlucas/speedtest/xml"
 )
 
+// testIgnoreIDs is the ignoreids list of sthttp_test_config.xml
+var testIgnoreIDs = strings.Split("683,1525,1719,1758,1762,1815,1816,1834,1839,1840,1850,1854,1859,1860,1861,1871,1873,1875,1877,1880,1913,3280,3383,3448,3695,3696,3697,3698,3699,3725,3726,3727,3728,3729,3730,3731,3733,3788,3913,4140,4533,4787,5085,5086,5087,5348,5517,5894,6130,6285,6397,6398,6412,7326,7334,7529,8591,8837,949,5249", ",")
+
 func TestCheckHTTPSuccess(t *testing.T) {
 	resp := http.Response{}
 	resp.StatusCode = 200
@@ -83,10 +90,19 @@ func TestNewClient(t *testing.T) {
 					NumLatencyTests: 1,
 				},
 				Config: &Config{
-					IP:  "23.124.0.25",
-					Lat: 32.5155,
-					Lon: -90.1118,
-					Isp: "AT&T U-verse",
+					IP:                    "23.124.0.25",
+					Lat:                   32.5155,
+					Lon:                   -90.1118,
+					Isp:                   "AT&T U-verse",
+					ThreadCount:           4,
+					IgnoreIDs:             testIgnoreIDs,
+					DownloadThreadsPerURL: 4,
+					DownloadTestLength:    10 * time.Second,
+					UploadThreads:         2,
+					UploadRatio:           5,
+					UploadMaxChunkSize:    512 * 1024,
+					UploadMaxChunkCount:   50,
+					UploadTestLength:      10 * time.Second,
 				},
 			},
 			wantErr: false,
@@ -99,7 +115,9 @@ func TestNewClient(t *testing.T) {
 				t.Errorf("NewClient() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
+			if !reflect.DeepEqual(got.Config, tt.want.Config) ||
+				!reflect.DeepEqual(got.SpeedtestConfig, tt.want.SpeedtestConfig) ||
+				got.Timeout != tt.want.Timeout {
 				t.Errorf("NewClient() = %v, want %v", got, tt.want)
 			}
 		})
@@ -242,6 +260,32 @@ func Test_checkHTTP(t *testing.T) {
 	}
 }
 
+func Test_parseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "32768", want: 32768},
+		{in: "512K", want: 512 * 1024},
+		{in: "2M", want: 2 * 1024 * 1024},
+		{in: "lots", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSize() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestClient_GetConfig(t *testing.T) {
 	x, err := ioutil.ReadFile("sthttp_test_config.xml")
 	if err != nil {
@@ -266,10 +310,19 @@ func TestClient_GetConfig(t *testing.T) {
 				Timeout:         (15 * time.Second),
 			},
 			wantC: Config{
-				IP:  "23.124.0.25",
-				Lat: 32.5155,
-				Lon: -90.1118,
-				Isp: "AT&T U-verse",
+				IP:                    "23.124.0.25",
+				Lat:                   32.5155,
+				Lon:                   -90.1118,
+				Isp:                   "AT&T U-verse",
+				ThreadCount:           4,
+				IgnoreIDs:             testIgnoreIDs,
+				DownloadThreadsPerURL: 4,
+				DownloadTestLength:    10 * time.Second,
+				UploadThreads:         2,
+				UploadRatio:           5,
+				UploadMaxChunkSize:    512 * 1024,
+				UploadMaxChunkCount:   50,
+				UploadTestLength:      10 * time.Second,
 			},
 			wantErr: false,
 		},
@@ -342,6 +395,109 @@ func TestClient_GetServers(t *testing.T) {
 	}
 }
 
+func TestClient_Offline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request for %s", r.URL)
+	}))
+	defer ts.Close()
+
+	t.Run("files", func(t *testing.T) {
+		client, err := NewClient(&SpeedtestConfig{
+			ConfigURL:   ts.URL,
+			ServersURL:  ts.URL,
+			ConfigFile:  "sthttp_test_config.xml",
+			ServersFile: "sthttp_test_servers.xml",
+		}, 15*time.Second)
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		if client.Config.IP != "23.124.0.25" {
+			t.Errorf("NewClient() config IP = %v, want %v", client.Config.IP, "23.124.0.25")
+		}
+
+		servers, err := client.GetServers()
+		if err != nil {
+			t.Fatalf("Client.GetServers() error = %v", err)
+		}
+		if len(servers) == 0 || servers[0].URL != "http://88.84.191.230/speedtest/upload.php" {
+			t.Errorf("Client.GetServers() = %v", servers)
+		}
+	})
+
+	t.Run("readers", func(t *testing.T) {
+		config, err := os.Open("sthttp_test_config.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer config.Close()
+		servers, err := os.Open("sthttp_test_servers.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer servers.Close()
+
+		client, err := NewClientFromReaders(&SpeedtestConfig{ServersURL: ts.URL, Blacklist: []string{"2630"}}, config, servers, 15*time.Second)
+		if err != nil {
+			t.Fatalf("NewClientFromReaders() error = %v", err)
+		}
+		if client.Config.Isp != "AT&T U-verse" {
+			t.Errorf("NewClientFromReaders() config ISP = %v, want %v", client.Config.Isp, "AT&T U-verse")
+		}
+
+		got, err := client.GetServers()
+		if err != nil {
+			t.Fatalf("Client.GetServers() error = %v", err)
+		}
+		if len(got) == 0 || len(got) >= len(client.Servers) {
+			t.Errorf("Client.GetServers() returned %d of %d servers, want the ignored ones dropped", len(got), len(client.Servers))
+		}
+		for _, server := range got {
+			if client.Ignored(server.ID) {
+				t.Errorf("Client.GetServers() returned ignored server %s", server.ID)
+			}
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := NewClient(&SpeedtestConfig{ConfigFile: "missing.xml"}, 15*time.Second)
+		if !os.IsNotExist(err) {
+			t.Errorf("NewClient() error = %v, want a missing file error", err)
+		}
+	})
+}
+
+func TestParseConfig(t *testing.T) {
+	if _, err := ParseConfig(strings.NewReader("<settings><client lat=\"north\"/></settings>")); err == nil {
+		t.Errorf("ParseConfig() error = nil, want an error for a bad latitude")
+	}
+	if _, err := ParseConfig(strings.NewReader("not xml")); err == nil {
+		t.Errorf("ParseConfig() error = nil, want an error for bad XML")
+	}
+}
+
+func TestParseServers(t *testing.T) {
+	serversXML := `<settings><servers><server id="7" lat="1" lon=""/><server id="8" lat="2" lon="3"/></servers></settings>`
+
+	logger := &recordingLogger{}
+	client, err := NewClientFromReaders(&SpeedtestConfig{Logger: logger}, strings.NewReader(`<settings><client lat="1" lon="1"/></settings>`), strings.NewReader(serversXML), 15*time.Second)
+	if err != nil {
+		t.Fatalf("NewClientFromReaders() error = %v", err)
+	}
+	if len(client.Servers) != 2 {
+		t.Fatalf("NewClientFromReaders() kept %d servers, want 2", len(client.Servers))
+	}
+	if got := client.Servers[0]; got.ID != "7" || got.Lat != 1 || got.Lon != 0 {
+		t.Errorf("NewClientFromReaders() server = %+v, want id 7 at 1, 0", got)
+	}
+	if !logger.has("WARN error parsing server lon") {
+		t.Errorf("logged %v, want the bad lon", logger.events)
+	}
+
+	if _, err := ParseServers(strings.NewReader("not xml")); err == nil {
+		t.Errorf("ParseServers() error = nil, want an error for bad XML")
+	}
+}
+
 func TestClient_GetClosestServers(t *testing.T) {
 	x, err := ioutil.ReadFile("sthttp_test_servers.xml")
 	if err != nil {
@@ -398,6 +554,53 @@ func TestClient_GetClosestServers(t *testing.T) {
 	}
 }
 
+func TestClient_Ignored(t *testing.T) {
+	x, err := ioutil.ReadFile("sthttp_test_servers.xml")
+	if err != nil {
+		t.Logf("Cannot read sthttp_test_servers.xml")
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, string(x))
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		SpeedtestConfig: &SpeedtestConfig{ServersURL: ts.URL, Blacklist: []string{"2630"}},
+		Config: &Config{
+			Lat:       32.5155,
+			Lon:       -90.1118,
+			IgnoreIDs: []string{"4600"},
+		},
+		Timeout: (15 * time.Second),
+	}
+
+	all, err := convertServers(x)
+	if err != nil {
+		t.Fatalf("error converting server fixture: %v", err)
+	}
+
+	servers, err := client.GetServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != len(all)-2 {
+		t.Errorf("Client.GetServers() returned %d servers, want %d", len(servers), len(all)-2)
+	}
+
+	for name, list := range map[string][]Server{"GetServers": servers, "GetClosestServers": client.GetClosestServers(all)} {
+		for _, s := range list {
+			if s.ID == "4600" || s.ID == "2630" {
+				t.Errorf("Client.%s() returned ignored server %s", name, s.ID)
+			}
+		}
+	}
+
+	if _, err := client.GetFastestServer([]Server{{ID: "2630", URL: ts.URL + "/upload.php"}}); err == nil {
+		t.Errorf("Client.GetFastestServer() picked a blacklisted server")
+	}
+}
+
 func TestClient_GetLatencyURL(t *testing.T) {
 	type args struct {
 		server Server
@@ -717,6 +920,218 @@ func TestClient_UploadSpeed(t *testing.T) {
 	}
 }
 
+func TestClient_ConnectionReuse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "test=test")
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		fresh      bool
+		wantReused bool
+	}{
+		{name: "shared transport", fresh: false, wantReused: true},
+		{name: "fresh connections", fresh: true, wantReused: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stClient := &Client{
+				SpeedtestConfig: &SpeedtestConfig{NumLatencyTests: 3, FreshConnections: tt.fresh},
+				Timeout:         (15 * time.Second),
+			}
+			defer stClient.CloseIdleConnections()
+
+			if _, err := stClient.DownloadSpeed(ts.URL); err != nil {
+				t.Fatalf("Client.DownloadSpeed() error = %v", err)
+			}
+
+			report, err := stClient.GetLatencyReportContext(context.Background(), ts.URL)
+			if err != nil {
+				t.Fatalf("Client.GetLatencyReportContext() error = %v", err)
+			}
+			for i, probe := range report.Probes {
+				if probe.Reused != tt.wantReused {
+					t.Errorf("probe %d reused = %v, want %v", i, probe.Reused, tt.wantReused)
+				}
+			}
+		})
+	}
+}
+
+func TestClient_CloseIdleConnectionsConcurrent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "test=test")
+	}))
+	defer ts.Close()
+
+	stClient := &Client{SpeedtestConfig: &SpeedtestConfig{}, Timeout: 15 * time.Second}
+
+	// run under -race, closing must not race with the first request building the transport
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stClient.CloseIdleConnections()
+	}()
+	if _, err := stClient.DownloadContext(context.Background(), ts.URL, ioutil.Discard); err != nil {
+		t.Errorf("Client.DownloadContext() error = %v", err)
+	}
+	wg.Wait()
+	stClient.CloseIdleConnections()
+}
+
+// recordingTransport records every request it forwards to the default transport
+type recordingTransport struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.requests = append(rt.requests, req.Method+" "+req.URL.Path)
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClient_Transport(t *testing.T) {
+	x, err := ioutil.ReadFile("sthttp_test_config.xml")
+	if err != nil {
+		t.Logf("Cannot read sthttp_test_config.xml")
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		fmt.Fprintln(w, string(x))
+	}))
+	defer ts.Close()
+
+	rt := &recordingTransport{}
+	stClient := &Client{
+		SpeedtestConfig: &SpeedtestConfig{
+			ConfigURL:       ts.URL + "/config",
+			ServersURL:      ts.URL + "/servers",
+			NumLatencyTests: 1,
+			Transport:       rt,
+			// ignored in favour of Transport
+			Interface: "speedtest-missing0",
+		},
+		Timeout: (15 * time.Second),
+	}
+
+	if _, err := stClient.GetConfig(); err != nil {
+		t.Fatalf("Client.GetConfig() error = %v", err)
+	}
+	if _, err := stClient.GetServers(); err != nil {
+		t.Fatalf("Client.GetServers() error = %v", err)
+	}
+	if _, err := stClient.GetLatency(ts.URL + "/latency.txt"); err != nil {
+		t.Fatalf("Client.GetLatency() error = %v", err)
+	}
+	if _, err := stClient.DownloadSpeed(ts.URL + "/random350x350.jpg"); err != nil {
+		t.Fatalf("Client.DownloadSpeed() error = %v", err)
+	}
+	if _, err := stClient.UploadSpeed(ts.URL+"/upload.php", "text/xml", []byte("data")); err != nil {
+		t.Fatalf("Client.UploadSpeed() error = %v", err)
+	}
+
+	want := []string{"GET /config", "GET /servers", "GET /latency.txt", "GET /random350x350.jpg", "POST /upload.php"}
+	if !reflect.DeepEqual(rt.requests, want) {
+		t.Errorf("transport saw %v, want %v", rt.requests, want)
+	}
+}
+
+func TestClient_HTTPClient(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "test=test")
+	}))
+	defer ts.Close()
+
+	stClient := &Client{
+		SpeedtestConfig: &SpeedtestConfig{NumLatencyTests: 1, HTTPClient: ts.Client()},
+		Timeout:         (15 * time.Second),
+	}
+
+	report, err := stClient.GetLatencyReportContext(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatalf("Client.GetLatencyReportContext() error = %v", err)
+	}
+	if report.Probes[0].TLS <= 0 {
+		t.Errorf("probe tls = %v, want the handshake to be timed", report.Probes[0].TLS)
+	}
+}
+
+func Test_localAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		iface   string
+		wantIP  string
+		wantErr bool
+	}{
+		{name: "unset", iface: ""},
+		{name: "source ip", iface: "127.0.0.1", wantIP: "127.0.0.1"},
+		{name: "loopback interface", iface: "lo", wantIP: "127.0.0.1"},
+		{name: "missing interface", iface: "speedtest-missing0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.iface == "lo" {
+				if _, err := net.InterfaceByName("lo"); err != nil {
+					t.Skip("no interface named lo")
+				}
+			}
+
+			got, err := localAddr(tt.iface)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("localAddr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantIP == "" {
+				if got != nil {
+					t.Errorf("localAddr() = %v, want nil", got)
+				}
+				return
+			}
+			if addr, ok := got.(*net.TCPAddr); !ok || addr.IP.String() != tt.wantIP {
+				t.Errorf("localAddr() = %v, want %v", got, tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestClient_Interface(t *testing.T) {
+	x, err := ioutil.ReadFile("sthttp_test_config.xml")
+	if err != nil {
+		t.Logf("Cannot read sthttp_test_config.xml")
+	}
+
+	var remoteAddr string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+		fmt.Fprintln(w, string(x))
+	}))
+	defer ts.Close()
+
+	bound := &Client{
+		SpeedtestConfig: &SpeedtestConfig{ConfigURL: ts.URL, Interface: "127.0.0.1"},
+		Timeout:         (15 * time.Second),
+	}
+	if _, err := bound.GetConfig(); err != nil {
+		t.Fatalf("Client.GetConfig() error = %v", err)
+	}
+	if host, _, _ := net.SplitHostPort(remoteAddr); host != "127.0.0.1" {
+		t.Errorf("request came from %v, want 127.0.0.1", remoteAddr)
+	}
+
+	missing := &Client{
+		SpeedtestConfig: &SpeedtestConfig{ConfigURL: ts.URL, Interface: "speedtest-missing0"},
+		Timeout:         (15 * time.Second),
+	}
+	if _, err := missing.GetConfig(); err == nil || !strings.Contains(err.Error(), "speedtest-missing0") {
+		t.Errorf("Client.GetConfig() error = %v, want it to name the interface", err)
+	}
+}
+
 func TestClient_getHTTPClient(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -739,3 +1154,54 @@ func TestClient_getHTTPClient(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_ContextCancelled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello World")
+	}))
+	defer ts.Close()
+
+	stClient := &Client{
+		SpeedtestConfig: &SpeedtestConfig{ConfigURL: ts.URL, ServersURL: ts.URL, NumLatencyTests: 3},
+		Timeout:         (15 * time.Second),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{
+			name: "config",
+			call: func() error { _, err := stClient.GetConfigContext(ctx); return err },
+		},
+		{
+			name: "servers",
+			call: func() error { _, err := stClient.GetServersContext(ctx); return err },
+		},
+		{
+			name: "latency",
+			call: func() error { _, err := stClient.GetLatencyContext(ctx, ts.URL); return err },
+		},
+		{
+			name: "download",
+			call: func() error { _, err := stClient.DownloadSpeedContext(ctx, ts.URL); return err },
+		},
+		{
+			name: "upload",
+			call: func() error {
+				_, err := stClient.UploadSpeedContext(ctx, ts.URL, "text/xml", []byte("data"))
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); err != context.Canceled {
+				t.Errorf("error = %v, want %v", err, context.Canceled)
+			}
+		})
+	}
+}
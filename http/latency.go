@@ -0,0 +1,276 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyReport summarises the latency probes sent to a server. Every
+// duration is in milliseconds and only covers the successful probes.
+type LatencyReport struct {
+	Samples []float64 `json:"samples_ms"`
+	Min     float64   `json:"min_ms"`
+	Max     float64   `json:"max_ms"`
+	Mean    float64   `json:"mean_ms"`
+	Median  float64   `json:"median_ms"`
+	StdDev  float64   `json:"stddev_ms"`
+	// Jitter is the mean difference between consecutive samples
+	Jitter float64 `json:"jitter_ms"`
+	// Failed is the number of probes that got no response
+	Failed int `json:"failed"`
+	// Probes breaks every successful probe down by phase
+	Probes []Probe `json:"probes,omitempty"`
+}
+
+// Probe is the timing of a single latency probe in milliseconds, broken
+// down by phase. Phases skipped by the probe, such as DNS and connecting
+// on a reused connection or TLS over plain HTTP, are 0.
+type Probe struct {
+	DNS     float64 `json:"dns_ms"`
+	Connect float64 `json:"connect_ms"`
+	TLS     float64 `json:"tls_ms"`
+	// TTFB is the time from the request being written to the first response byte
+	TTFB float64 `json:"ttfb_ms"`
+	// Total is the time from sending the request to the response, the probe's latency
+	Total float64 `json:"total_ms"`
+	// Reused is set when the probe went over an existing connection
+	Reused bool `json:"reused"`
+}
+
+// NewLatencyReport computes the statistics of samples, in probe order, alongside failed lost probes
+func NewLatencyReport(samples []float64, failed int) LatencyReport {
+	report := LatencyReport{Samples: samples, Failed: failed}
+	if len(samples) == 0 {
+		return report
+	}
+
+	var total float64
+	report.Min = samples[0]
+	report.Max = samples[0]
+	for i, sample := range samples {
+		total += sample
+		report.Min = math.Min(report.Min, sample)
+		report.Max = math.Max(report.Max, sample)
+		if i > 0 {
+			report.Jitter += math.Abs(sample - samples[i-1])
+		}
+	}
+	report.Mean = total / float64(len(samples))
+	if len(samples) > 1 {
+		report.Jitter = report.Jitter / float64(len(samples)-1)
+	}
+
+	var variance float64
+	for _, sample := range samples {
+		variance += (sample - report.Mean) * (sample - report.Mean)
+	}
+	report.StdDev = math.Sqrt(variance / float64(len(samples)))
+
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		report.Median = (sorted[middle-1] + sorted[middle]) / 2
+	} else {
+		report.Median = sorted[middle]
+	}
+
+	return report
+}
+
+// PhaseMeans averages every phase over the probes
+func (report LatencyReport) PhaseMeans() Probe {
+	var mean Probe
+	if len(report.Probes) == 0 {
+		return mean
+	}
+
+	for _, probe := range report.Probes {
+		mean.DNS += probe.DNS
+		mean.Connect += probe.Connect
+		mean.TLS += probe.TLS
+		mean.TTFB += probe.TTFB
+		mean.Total += probe.Total
+	}
+
+	n := float64(len(report.Probes))
+	mean.DNS = mean.DNS / n
+	mean.Connect = mean.Connect / n
+	mean.TLS = mean.TLS / n
+	mean.TTFB = mean.TTFB / n
+	mean.Total = mean.Total / n
+	return mean
+}
+
+// Loss is the fraction of probes that failed
+func (report LatencyReport) Loss() float64 {
+	sent := len(report.Samples) + report.Failed
+	if sent == 0 {
+		return 0
+	}
+	return float64(report.Failed) / float64(sent)
+}
+
+// GetLatencyReportContext probes the given url NUMLATENCYTESTS times and
+// reports on every latency. Failed probes are counted rather than
+// aborting the test, which only errors when ctx is done or every probe failed.
+func (stClient *Client) GetLatencyReportContext(ctx context.Context, url string) (LatencyReport, error) {
+	var samples []float64
+	var probes []Probe
+	var failed int
+	var lastErr error
+
+	newReport := func() LatencyReport {
+		report := NewLatencyReport(samples, failed)
+		report.Probes = probes
+		return report
+	}
+
+	for i := 0; i < stClient.SpeedtestConfig.NumLatencyTests; i++ {
+		if err := ctx.Err(); err != nil {
+			return newReport(), err
+		}
+
+		probe, err := stClient.probeLatency(ctx, url)
+		if err != nil {
+			if ctx.Err() != nil {
+				return newReport(), ctx.Err()
+			}
+			stClient.logger().Debug("latency probe failed", "url", url, "error", err)
+			failed++
+			lastErr = err
+			continue
+		}
+		stClient.logger().Debug("latency probe", "url", url, "ms", probe.Total, "reused", probe.Reused)
+
+		samples = append(samples, probe.Total)
+		probes = append(probes, probe)
+	}
+
+	report := newReport()
+	if len(samples) == 0 && failed > 0 {
+		return report, lastErr
+	}
+	return report, nil
+}
+
+// probeLatency times a single request to url up to its response headers,
+// tracing the DNS, connect, TLS and time to first byte phases on the way
+func (stClient *Client) probeLatency(ctx context.Context, url string) (probe Probe, err error) {
+	var trace *probeTrace
+	var start time.Time
+	resp, err := stClient.do(ctx, func() (*http.Request, error) {
+		// every attempt is traced and timed afresh, so only the last counts
+		trace = &probeTrace{}
+		start = time.Now()
+		return stClient.newRequest(httptrace.WithClientTrace(ctx, trace.clientTrace()), "GET", url, nil)
+	})
+	if err != nil {
+		return probe, err
+	}
+
+	defer func() {
+		closeErr := resp.Body.Close()
+		if closeErr != nil {
+			stClient.logger().Warn("error closing body of latency request", "url", url, "error", closeErr)
+		}
+	}()
+
+	finish := time.Now()
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return probe, contextError(ctx, err)
+	}
+	if err := statusError(resp); err != nil {
+		return probe, err
+	}
+
+	probe = trace.probe()
+	probe.Total = milliseconds(finish.Sub(start))
+	return probe, nil
+}
+
+// probeTrace records when each phase of a request starts and ends. Dialing
+// may race several addresses so every hook takes the lock.
+type probeTrace struct {
+	mu sync.Mutex
+
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	wroteRequest, firstByte   time.Time
+	reused                    bool
+}
+
+func (t *probeTrace) clientTrace() *httptrace.ClientTrace {
+	mark := func(at *time.Time) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if at.IsZero() {
+			*at = time.Now()
+		}
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { mark(&t.dnsDone) },
+		ConnectStart:         func(string, string) { mark(&t.connectStart) },
+		ConnectDone:          func(string, string, error) { mark(&t.connectDone) },
+		TLSHandshakeStart:    func() { mark(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { mark(&t.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { mark(&t.firstByte) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.reused = info.Reused
+		},
+	}
+}
+
+// probe converts the recorded times to phase durations
+func (t *probeTrace) probe() Probe {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return Probe{
+		DNS:     phase(t.dnsStart, t.dnsDone),
+		Connect: phase(t.connectStart, t.connectDone),
+		TLS:     phase(t.tlsStart, t.tlsDone),
+		TTFB:    phase(t.wroteRequest, t.firstByte),
+		Reused:  t.reused,
+	}
+}
+
+// phase is the milliseconds between start and end, or 0 when either never happened
+func phase(start, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return milliseconds(end.Sub(start))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / 1000000
+}
+
+// MeasureServerContext probes server's latency and returns it with its
+// Latency and LatencyReport filled in
+func (stClient *Client) MeasureServerContext(ctx context.Context, server Server) (Server, error) {
+	report, err := stClient.GetLatencyReportContext(ctx, stClient.GetLatencyURL(server))
+	if err != nil {
+		return server, err
+	}
+
+	server.Latency = stClient.reduceLatency(report.Samples)
+	server.LatencyReport = &report
+	stClient.logger().Debug("measured server", "id", server.ID, "latency_ms", server.Latency, "jitter_ms", report.Jitter, "failed", report.Failed)
+	return server, nil
+}
@@ -0,0 +1,156 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewLatencyReport(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []float64
+		failed  int
+		want    LatencyReport
+	}{
+		{
+			name:   "no samples",
+			failed: 2,
+			want:   LatencyReport{Failed: 2},
+		},
+		{
+			name:    "one sample",
+			samples: []float64{10},
+			want:    LatencyReport{Samples: []float64{10}, Min: 10, Max: 10, Mean: 10, Median: 10},
+		},
+		{
+			name:    "odd samples",
+			samples: []float64{10, 14, 12, 18, 16},
+			failed:  1,
+			want: LatencyReport{
+				Samples: []float64{10, 14, 12, 18, 16},
+				Min:     10,
+				Max:     18,
+				Mean:    14,
+				Median:  14,
+				StdDev:  2.8284271247461903,
+				Jitter:  3.5,
+				Failed:  1,
+			},
+		},
+		{
+			name:    "even samples",
+			samples: []float64{20, 10, 30, 40},
+			want: LatencyReport{
+				Samples: []float64{20, 10, 30, 40},
+				Min:     10,
+				Max:     40,
+				Mean:    25,
+				Median:  25,
+				StdDev:  11.180339887498949,
+				Jitter:  13.333333333333334,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewLatencyReport(tt.samples, tt.failed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewLatencyReport() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatencyReport_Loss(t *testing.T) {
+	report := LatencyReport{Samples: []float64{10, 12, 11}, Failed: 1}
+	if got := report.Loss(); got != 0.25 {
+		t.Errorf("LatencyReport.Loss() = %v, want 0.25", got)
+	}
+	if got := (LatencyReport{}).Loss(); got != 0 {
+		t.Errorf("LatencyReport.Loss() = %v, want 0", got)
+	}
+}
+
+func TestClient_GetLatencyReportContext(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// drop every other probe without a response
+		if atomic.AddInt32(&requests, 1)%2 == 0 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprintln(w, "test=test")
+	}))
+	defer ts.Close()
+
+	// fresh connections keep the transport from retrying dropped probes
+	stClient := &Client{
+		SpeedtestConfig: &SpeedtestConfig{NumLatencyTests: 4, FreshConnections: true},
+		Timeout:         (15 * time.Second),
+	}
+
+	got, err := stClient.GetLatencyReportContext(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatalf("Client.GetLatencyReportContext() error = %v", err)
+	}
+	if len(got.Samples) != 2 || got.Failed != 2 {
+		t.Errorf("Client.GetLatencyReportContext() = %d samples and %d failed, want 2 and 2", len(got.Samples), got.Failed)
+	}
+
+	if _, err := stClient.GetLatencyReportContext(context.Background(), "planned bad request"); err == nil {
+		t.Errorf("Client.GetLatencyReportContext() error = nil when every probe failed")
+	}
+
+	server, err := stClient.MeasureServerContext(context.Background(), Server{URL: ts.URL + "/upload.php"})
+	if err != nil {
+		t.Fatalf("Client.MeasureServerContext() error = %v", err)
+	}
+	if server.LatencyReport == nil || server.Latency != server.LatencyReport.Mean {
+		t.Errorf("Client.MeasureServerContext() = %+v, want the latency report mean", server)
+	}
+}
+
+func TestClient_probeLatency(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintln(w, "test=test")
+	}))
+	defer ts.Close()
+
+	stClient := &Client{
+		SpeedtestConfig: &SpeedtestConfig{NumLatencyTests: 2},
+		Timeout:         (15 * time.Second),
+	}
+
+	report, err := stClient.GetLatencyReportContext(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatalf("Client.GetLatencyReportContext() error = %v", err)
+	}
+	if len(report.Probes) != 2 {
+		t.Fatalf("Client.GetLatencyReportContext() = %d probes, want 2", len(report.Probes))
+	}
+
+	probe := report.Probes[0]
+	if probe.Connect <= 0 {
+		t.Errorf("probe connect = %v, want a connection to be timed", probe.Connect)
+	}
+	if probe.TLS != 0 {
+		t.Errorf("probe tls = %v, want 0 over plain HTTP", probe.TLS)
+	}
+	if probe.TTFB < 20 || probe.Total < probe.TTFB {
+		t.Errorf("probe ttfb = %v, total = %v, want the 20ms handler delay within both", probe.TTFB, probe.Total)
+	}
+	if probe.Total != report.Samples[0] {
+		t.Errorf("probe total = %v, want the sample %v", probe.Total, report.Samples[0])
+	}
+
+	if mean := report.PhaseMeans(); mean.TTFB < 20 {
+		t.Errorf("LatencyReport.PhaseMeans() ttfb = %v, want at least 20", mean.TTFB)
+	}
+}
@@ -0,0 +1,39 @@
+package http
+
+import "log/slog"
+
+// Logger receives structured log events, with args given as alternating
+// keys and values the way log/slog takes them. *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// NopLogger discards every event, and is what a client without a Logger uses
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// NewSlogLogger adapts logger, slog.Default() when nil, tagging every event
+// with component=speedtest
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With("component", "speedtest")
+}
+
+// logger returns the client's Logger, NopLogger when it has none
+func (stClient *Client) logger() Logger {
+	if stClient == nil || stClient.Logger == nil {
+		return NopLogger
+	}
+	return stClient.Logger
+}
@@ -0,0 +1,122 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps the level and message of every event
+type recordingLogger struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *recordingLogger) record(level, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, level+" "+msg)
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("DEBUG", msg) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("INFO", msg) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("WARN", msg) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("ERROR", msg) }
+
+func (l *recordingLogger) has(event string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClient_Logger(t *testing.T) {
+	x, err := ioutil.ReadFile("sthttp_test_servers.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintln(w, string(x))
+	}))
+	defer ts.Close()
+
+	logger := &recordingLogger{}
+	stClient := &Client{
+		SpeedtestConfig: &SpeedtestConfig{ServersURL: ts.URL, ServerCache: NewMemoryCache(), ServerCacheTTL: time.Nanosecond},
+		Timeout:         15 * time.Second,
+		Logger:          logger,
+	}
+
+	if _, err := stClient.GetServers(); err != nil {
+		t.Fatalf("Client.GetServers() error = %v", err)
+	}
+	failing = true
+	if _, err := stClient.GetServers(); err != nil {
+		t.Fatalf("Client.GetServers() error = %v", err)
+	}
+
+	for _, want := range []string{
+		"DEBUG fetching server list",
+		"DEBUG loaded server list",
+		"WARN error fetching server list, using the cached one",
+	} {
+		if !logger.has(want) {
+			t.Errorf("logged %v, want %q", logger.events, want)
+		}
+	}
+}
+
+func TestNewSlogLogger(t *testing.T) {
+	x, err := ioutil.ReadFile("sthttp_test_config.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, string(x))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	if _, err := NewClient(&SpeedtestConfig{ConfigURL: ts.URL, Logger: logger}, 15*time.Second); err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	got := buf.String()
+	for _, want := range []string{
+		`level=DEBUG msg="fetching config" component=speedtest url=` + ts.URL,
+		`msg="loaded config" component=speedtest ip=23.124.0.25`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("slog output is missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestNopLogger(t *testing.T) {
+	var stClient *Client
+	if stClient.logger() != NopLogger {
+		t.Errorf("nil Client logger() = %v, want NopLogger", stClient.logger())
+	}
+	if (&Client{}).logger() != NopLogger {
+		t.Errorf("Client{}.logger() is not NopLogger")
+	}
+}
@@ -0,0 +1,67 @@
+package http
+
+import (
+	"sort"
+	"strings"
+)
+
+// ServerQuery narrows down a server list. Empty fields match every server.
+type ServerQuery struct {
+	// Country matches the server country, ignoring case
+	Country string
+	// CC matches the two letter country code, ignoring case
+	CC string
+	// Sponsor matches servers whose sponsor contains it, ignoring case
+	Sponsor string
+	// Name matches servers whose name contains it, ignoring case
+	Name string
+	// Radius keeps servers at most this many kilometers from the client
+	Radius float64
+	// Max caps the number of servers returned
+	Max int
+}
+
+// Matches reports whether server satisfies every field of the query but Max
+func (q ServerQuery) Matches(server Server) bool {
+	if q.Country != "" && !strings.EqualFold(server.Country, q.Country) {
+		return false
+	}
+	if q.CC != "" && !strings.EqualFold(server.CC, q.CC) {
+		return false
+	}
+	if q.Sponsor != "" && !containsFold(server.Sponsor, q.Sponsor) {
+		return false
+	}
+	if q.Name != "" && !containsFold(server.Name, q.Name) {
+		return false
+	}
+	if q.Radius > 0 && server.Distance > q.Radius {
+		return false
+	}
+	return true
+}
+
+// QueryServers returns the servers matching q sorted by their distance
+// from the client, computing those distances when the client config is known
+func (stClient *Client) QueryServers(servers []Server, q ServerQuery) []Server {
+	if stClient.Config != nil {
+		servers = stClient.GetClosestServers(servers)
+	} else {
+		sort.Sort(ByDistance(servers))
+	}
+
+	var matches []Server
+	for _, server := range servers {
+		if q.Max > 0 && len(matches) == q.Max {
+			break
+		}
+		if q.Matches(server) {
+			matches = append(matches, server)
+		}
+	}
+	return matches
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
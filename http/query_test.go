@@ -0,0 +1,82 @@
+package http
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestClient_QueryServers(t *testing.T) {
+	x, err := ioutil.ReadFile("sthttp_test_servers.xml")
+	if err != nil {
+		t.Fatalf("Cannot read sthttp_test_servers.xml")
+	}
+
+	servers, err := convertServers(x)
+	if err != nil {
+		t.Fatalf("error converting server fixture: %v", err)
+	}
+
+	client := &Client{
+		SpeedtestConfig: &SpeedtestConfig{},
+		Config: &Config{
+			Lat: 32.5155,
+			Lon: -90.1118,
+		},
+	}
+
+	tests := []struct {
+		name    string
+		query   ServerQuery
+		wantLen int
+		check   func(Server) bool
+	}{
+		{
+			name:    "closest",
+			query:   ServerQuery{Max: 1},
+			wantLen: 1,
+			check:   func(s Server) bool { return s.ID == "2630" },
+		},
+		{
+			name:    "country code",
+			query:   ServerQuery{CC: "no", Max: 5},
+			wantLen: 5,
+			check:   func(s Server) bool { return s.CC == "NO" },
+		},
+		{
+			name:    "sponsor substring",
+			query:   ServerQuery{Sponsor: "TELEPAK"},
+			wantLen: -1,
+			check:   func(s Server) bool { return containsFold(s.Sponsor, "telepak") },
+		},
+		{
+			name:    "radius",
+			query:   ServerQuery{Radius: 100},
+			wantLen: -1,
+			check:   func(s Server) bool { return s.Distance <= 100 },
+		},
+		{
+			name:    "no match",
+			query:   ServerQuery{Country: "Atlantis"},
+			wantLen: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := client.QueryServers(servers, tt.query)
+			if tt.wantLen >= 0 && len(got) != tt.wantLen {
+				t.Fatalf("Client.QueryServers() returned %d servers, want %d", len(got), tt.wantLen)
+			}
+			if tt.wantLen < 0 && len(got) == 0 {
+				t.Fatalf("Client.QueryServers() returned no servers")
+			}
+			for i, s := range got {
+				if tt.check != nil && !tt.check(s) {
+					t.Errorf("Client.QueryServers() returned non-matching server %v", s)
+				}
+				if i > 0 && s.Distance < got[i-1].Distance {
+					t.Errorf("Client.QueryServers() is not sorted by distance at %d", i)
+				}
+			}
+		})
+	}
+}
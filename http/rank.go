@@ -0,0 +1,95 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultProbeWorkers is how many servers are probed at once when the config sets no ProbeWorkers
+const DefaultProbeWorkers = 4
+
+// RankServers probes servers and returns the reachable ones, fastest first
+func (stClient *Client) RankServers(servers []Server) ([]Server, error) {
+	return stClient.RankServersContext(context.Background(), servers)
+}
+
+// RankServersContext probes the first NumClosest servers concurrently, on up
+// to ProbeWorkers connections and within ProbeTimeout each, and returns the
+// reachable ones with their Latency and LatencyReport filled in, fastest
+// first. An unreachable server is replaced by the next candidate up to
+// NumClosest times, so ranking gives up once NumClosest+1 servers have
+// proven unreachable. Servers the config ignores are never probed.
+func (stClient *Client) RankServersContext(ctx context.Context, servers []Server) ([]Server, error) {
+	type outcome struct {
+		server Server
+		err    error
+	}
+
+	servers = stClient.withoutIgnored(servers)
+
+	want := stClient.SpeedtestConfig.NumClosest
+	if want < 1 {
+		want = len(servers)
+	}
+	workers := stClient.SpeedtestConfig.ProbeWorkers
+	if workers < 1 {
+		workers = DefaultProbeWorkers
+	}
+
+	var ranked []Server
+	var lastErr error
+	var unreachable, next, inFlight int
+	results := make(chan outcome)
+
+	probe := func(server Server) {
+		probeCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout := stClient.SpeedtestConfig.ProbeTimeout; timeout > 0 {
+			probeCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		defer cancel()
+
+		measured, err := stClient.MeasureServerContext(probeCtx, server)
+		results <- outcome{server: measured, err: err}
+	}
+
+	launch := func() {
+		for inFlight < workers && next < len(servers) && len(ranked)+inFlight < want &&
+			unreachable <= want && ctx.Err() == nil {
+			go probe(servers[next])
+			next++
+			inFlight++
+		}
+	}
+
+	for launch(); inFlight > 0; launch() {
+		result := <-results
+		inFlight--
+
+		switch {
+		case result.err != nil && ctx.Err() != nil:
+			// drain the probes still running before returning
+		case result.err != nil:
+			stClient.logger().Debug("skipping unreachable server", "id", result.server.ID, "error", result.err)
+			lastErr = result.err
+			unreachable++
+		// Latency is in milliseconds, and a server a minute away is not worth testing
+		case result.server.Latency < time.Minute.Seconds()*1000:
+			ranked = append(ranked, result.server)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranked) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoServersAvailable, lastErr)
+	}
+	if len(ranked) == 0 {
+		return nil, ErrNoServersAvailable
+	}
+
+	sort.Stable(ByLatency(ranked))
+	return ranked, nil
+}
@@ -0,0 +1,184 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// delayServer answers latency requests for /<delay in ms>/speedtest/latency.txt after that delay
+func delayServer(running, peak *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(running, 1)
+		defer atomic.AddInt32(running, -1)
+		for {
+			p := atomic.LoadInt32(peak)
+			if n <= p || atomic.CompareAndSwapInt32(peak, p, n) {
+				break
+			}
+		}
+
+		var ms int
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/"), "%d", &ms)
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+		fmt.Fprintln(w, "test=test")
+	}))
+}
+
+func TestClient_RankServers(t *testing.T) {
+	var running, peak int32
+	ts := delayServer(&running, &peak)
+	defer ts.Close()
+
+	gone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	gone.Close()
+
+	var failedProbes int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failedProbes, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	broken := func(id string) Server {
+		return Server{ID: id, URL: failing.URL + "/speedtest/upload.php"}
+	}
+
+	server := func(id string, delay int) Server {
+		return Server{ID: id, URL: fmt.Sprintf("%s/%d/speedtest/upload.php", ts.URL, delay)}
+	}
+
+	tests := []struct {
+		name    string
+		config  *SpeedtestConfig
+		servers []Server
+		want    []string
+		// wantErr expects ranking to give up after wantFailedProbes broken servers
+		wantErr          bool
+		wantFailedProbes int32
+	}{
+		{
+			name:    "ranked by latency",
+			config:  &SpeedtestConfig{NumClosest: 3, NumLatencyTests: 1, ProbeWorkers: 2},
+			servers: []Server{server("1", 120), server("2", 20), server("3", 70), server("4", 0)},
+			want:    []string{"2", "3", "1"},
+		},
+		{
+			name:   "unreachable replaced",
+			config: &SpeedtestConfig{NumClosest: 2, NumLatencyTests: 1},
+			servers: []Server{
+				{ID: "1", URL: gone.URL + "/speedtest/upload.php"},
+				server("2", 40),
+				server("3", 0),
+			},
+			want: []string{"3", "2"},
+		},
+		{
+			name:             "gives up after NumClosest replacements",
+			config:           &SpeedtestConfig{NumClosest: 2, NumLatencyTests: 1, ProbeWorkers: 1},
+			servers:          []Server{broken("1"), broken("2"), broken("3"), broken("4"), server("5", 0)},
+			wantErr:          true,
+			wantFailedProbes: 3,
+		},
+		{
+			name:    "probe timeout",
+			config:  &SpeedtestConfig{NumClosest: 1, NumLatencyTests: 1, ProbeTimeout: 100 * time.Millisecond},
+			servers: []Server{server("1", 1000), server("2", 0)},
+			want:    []string{"2"},
+		},
+		{
+			name:    "ignored never probed",
+			config:  &SpeedtestConfig{NumClosest: 2, NumLatencyTests: 1, Blacklist: []string{"1"}},
+			servers: []Server{server("1", 0), server("2", 0)},
+			want:    []string{"2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&peak, 0)
+			atomic.StoreInt32(&failedProbes, 0)
+			stClient := &Client{SpeedtestConfig: tt.config, Timeout: 15 * time.Second}
+
+			got, err := stClient.RankServers(tt.servers)
+			if tt.wantErr {
+				if !errors.Is(err, ErrNoServersAvailable) {
+					t.Errorf("Client.RankServers() = %v, %v, want %v", got, err, ErrNoServersAvailable)
+				}
+				if n := atomic.LoadInt32(&failedProbes); n != tt.wantFailedProbes {
+					t.Errorf("probed %d unreachable servers before giving up, want %d", n, tt.wantFailedProbes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Client.RankServers() error = %v", err)
+			}
+
+			var ids []string
+			for _, s := range got {
+				ids = append(ids, s.ID)
+				if s.LatencyReport == nil || s.Latency <= 0 {
+					t.Errorf("Client.RankServers() server %s has no latency", s.ID)
+				}
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Client.RankServers() = %v, want %v", ids, tt.want)
+			}
+
+			workers := int32(tt.config.ProbeWorkers)
+			if workers == 0 {
+				workers = DefaultProbeWorkers
+			}
+			if p := atomic.LoadInt32(&peak); p > workers {
+				t.Errorf("%d probes ran at once, want at most %d", p, workers)
+			}
+		})
+	}
+}
+
+func TestClient_RankServersConcurrent(t *testing.T) {
+	var running, peak int32
+	ts := delayServer(&running, &peak)
+	defer ts.Close()
+
+	var servers []Server
+	for i := 0; i < 4; i++ {
+		servers = append(servers, Server{ID: fmt.Sprint(i), URL: ts.URL + "/100/speedtest/upload.php"})
+	}
+
+	stClient := &Client{SpeedtestConfig: &SpeedtestConfig{NumClosest: 4, NumLatencyTests: 1, ProbeWorkers: 4}, Timeout: 15 * time.Second}
+
+	start := time.Now()
+	if _, err := stClient.RankServers(servers); err != nil {
+		t.Fatalf("Client.RankServers() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 350*time.Millisecond {
+		t.Errorf("ranking 4 servers taking 100ms each took %v, want them probed concurrently", elapsed)
+	}
+	if p := atomic.LoadInt32(&peak); p < 2 {
+		t.Errorf("at most %d probes ran at once, want them concurrent", p)
+	}
+}
+
+func TestClient_RankServersCancelled(t *testing.T) {
+	var running, peak int32
+	ts := delayServer(&running, &peak)
+	defer ts.Close()
+
+	stClient := &Client{SpeedtestConfig: &SpeedtestConfig{NumClosest: 2, NumLatencyTests: 1}, Timeout: 15 * time.Second}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := stClient.RankServersContext(ctx, []Server{
+		{ID: "1", URL: ts.URL + "/500/speedtest/upload.php"},
+		{ID: "2", URL: ts.URL + "/500/speedtest/upload.php"},
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Client.RankServersContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
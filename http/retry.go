@@ -0,0 +1,123 @@
+package http
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// DefaultRetryableStatuses are the statuses retried when a RetryPolicy lists none
+var DefaultRetryableStatuses = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy controls how requests failing with a network error or a
+// retryable status are retried
+type RetryPolicy struct {
+	// Attempts is the total number of tries, so 1 or less never retries
+	Attempts int
+	// Backoff is the wait before the first retry, doubling for every retry after it
+	Backoff time.Duration
+	// MaxBackoff caps the wait between retries when non-zero
+	MaxBackoff time.Duration
+	// RetryableStatuses lists the statuses worth retrying, DefaultRetryableStatuses when nil
+	RetryableStatuses []int
+}
+
+// retryable reports whether a response with status should be retried
+func (policy *RetryPolicy) retryable(status int) bool {
+	statuses := policy.RetryableStatuses
+	if statuses == nil {
+		statuses = DefaultRetryableStatuses
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before retry number retry, counting from 1
+func (policy *RetryPolicy) backoff(retry int) time.Duration {
+	wait := policy.Backoff
+	for i := 1; i < retry; i++ {
+		wait *= 2
+		if policy.MaxBackoff > 0 && wait >= policy.MaxBackoff {
+			break
+		}
+	}
+	if policy.MaxBackoff > 0 && wait > policy.MaxBackoff {
+		wait = policy.MaxBackoff
+	}
+	return wait
+}
+
+// newRequest builds a request carrying the headers every speedtest request sends
+func (stClient *Client) newRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("User-Agent", stClient.SpeedtestConfig.UserAgent)
+	return req, nil
+}
+
+// do sends the request made by build, calling it again for every retry the
+// config's RetryPolicy allows after a network error or a retryable status.
+// A request whose body cannot be replayed is only sent once. The response
+// of the final attempt is returned for the caller to check its status.
+func (stClient *Client) do(ctx context.Context, build func() (*http.Request, error)) (*http.Response, error) {
+	client, err := stClient.getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	policy := stClient.SpeedtestConfig.Retry
+	for attempt := 1; ; attempt++ {
+		req, err := build()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			err = contextError(ctx, err)
+		}
+
+		last := policy == nil || attempt >= policy.Attempts || ctx.Err() != nil ||
+			(req.Body != nil && req.Body != http.NoBody && req.GetBody == nil)
+		if err == nil && (last || !policy.retryable(resp.StatusCode)) {
+			return resp, nil
+		}
+		if last {
+			return nil, err
+		}
+
+		if err == nil {
+			err = statusError(resp)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		wait := policy.backoff(attempt)
+		stClient.logger().Debug("retrying request", "url", req.URL.String(), "attempt", attempt, "wait", wait, "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
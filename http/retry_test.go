@@ -0,0 +1,229 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := &RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{retry: 1, want: 100 * time.Millisecond},
+		{retry: 2, want: 200 * time.Millisecond},
+		{retry: 4, want: 800 * time.Millisecond},
+		{retry: 5, want: time.Second},
+		{retry: 60, want: time.Second},
+	}
+	for _, tt := range tests {
+		if got := policy.backoff(tt.retry); got != tt.want {
+			t.Errorf("RetryPolicy.backoff(%d) = %v, want %v", tt.retry, got, tt.want)
+		}
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	x, err := ioutil.ReadFile("sthttp_test_config.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		failures     int32
+		status       int
+		policy       *RetryPolicy
+		wantRequests int32
+		wantStatus   int
+	}{
+		{
+			name:         "recovers",
+			failures:     2,
+			status:       http.StatusServiceUnavailable,
+			policy:       &RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+			wantRequests: 3,
+		},
+		{
+			name:         "gives up",
+			failures:     5,
+			status:       http.StatusServiceUnavailable,
+			policy:       &RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+			wantRequests: 3,
+			wantStatus:   http.StatusServiceUnavailable,
+		},
+		{
+			name:         "not retryable",
+			failures:     1,
+			status:       http.StatusNotFound,
+			policy:       &RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+			wantRequests: 1,
+			wantStatus:   http.StatusNotFound,
+		},
+		{
+			name:         "custom statuses",
+			failures:     1,
+			status:       http.StatusNotFound,
+			policy:       &RetryPolicy{Attempts: 2, RetryableStatuses: []int{http.StatusNotFound}},
+			wantRequests: 2,
+		},
+		{
+			name:         "no policy",
+			failures:     1,
+			status:       http.StatusServiceUnavailable,
+			wantRequests: 1,
+			wantStatus:   http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= tt.failures {
+					w.WriteHeader(tt.status)
+					return
+				}
+				fmt.Fprintln(w, string(x))
+			}))
+			defer ts.Close()
+
+			_, err := NewClient(&SpeedtestConfig{ConfigURL: ts.URL, Retry: tt.policy}, 15*time.Second)
+
+			var statusErr *HTTPStatusError
+			switch {
+			case tt.wantStatus == 0 && err != nil:
+				t.Errorf("NewClient() error = %v", err)
+			case tt.wantStatus != 0 && (!errors.As(err, &statusErr) || statusErr.StatusCode != tt.wantStatus):
+				t.Errorf("NewClient() error = %v, want status %d", err, tt.wantStatus)
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Errorf("made %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestClient_RetryUpload(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         func() io.Reader
+		wantN        int64
+		wantErr      bool
+		wantRequests int32
+	}{
+		{
+			name:         "replayable body",
+			body:         func() io.Reader { return strings.NewReader("abc") },
+			wantN:        3,
+			wantRequests: 3,
+		},
+		{
+			name:         "body that cannot be replayed",
+			body:         func() io.Reader { return ioutil.NopCloser(strings.NewReader("abc")) },
+			wantN:        3,
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				if string(b) != "abc" {
+					t.Errorf("uploaded %q, want %q", b, "abc")
+				}
+				if atomic.AddInt32(&requests, 1) < 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer ts.Close()
+
+			stClient := &Client{
+				SpeedtestConfig: &SpeedtestConfig{Retry: &RetryPolicy{Attempts: 3}},
+				Timeout:         15 * time.Second,
+			}
+
+			n, err := stClient.UploadContext(context.Background(), ts.URL, "text/xml", tt.body(), nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Client.UploadContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n != tt.wantN {
+				t.Errorf("Client.UploadContext() = %d, want %d", n, tt.wantN)
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Errorf("sent the upload %d times, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestClient_RetryLatency(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1)%2 == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintln(w, "test=test")
+	}))
+	defer ts.Close()
+
+	stClient := &Client{
+		SpeedtestConfig: &SpeedtestConfig{NumLatencyTests: 3, Retry: &RetryPolicy{Attempts: 2}},
+		Timeout:         15 * time.Second,
+	}
+
+	report, err := stClient.GetLatencyReportContext(context.Background(), ts.URL+"/speedtest/latency.txt")
+	if err != nil {
+		t.Fatalf("Client.GetLatencyReportContext() error = %v", err)
+	}
+	if len(report.Samples) != 3 || report.Failed != 0 {
+		t.Errorf("Client.GetLatencyReportContext() = %d samples, %d failed, want 3 and 0", len(report.Samples), report.Failed)
+	}
+}
+
+func TestClient_GetFastestServerSkipsUnreachable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "test=test")
+	}))
+	defer ts.Close()
+
+	gone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	gone.Close()
+
+	stClient := &Client{
+		SpeedtestConfig: &SpeedtestConfig{NumClosest: 1, NumLatencyTests: 1},
+		Timeout:         15 * time.Second,
+	}
+
+	got, err := stClient.GetFastestServer([]Server{
+		{ID: "1", URL: gone.URL + "/speedtest/upload.php"},
+		{ID: "2", URL: ts.URL + "/speedtest/upload.php"},
+	})
+	if err != nil {
+		t.Fatalf("Client.GetFastestServer() error = %v", err)
+	}
+	if got.ID != "2" {
+		t.Errorf("Client.GetFastestServer() = %v, want the reachable server 2", got.ID)
+	}
+
+	_, err = stClient.GetFastestServer([]Server{
+		{ID: "1", URL: gone.URL + "/speedtest/upload.php"},
+		{ID: "3", URL: gone.URL + "/other/upload.php"},
+	})
+	if !errors.Is(err, ErrNoServersAvailable) {
+		t.Errorf("Client.GetFastestServer() error = %v, want %v", err, ErrNoServersAvailable)
+	}
+}
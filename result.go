@@ -0,0 +1,82 @@
+package speedtest
+
+import (
+	"context"
+	"time"
+
+	"github.com/kylegrantlucas/speedtest/http"
+)
+
+// Result is the outcome of a full speedtest run
+type Result struct {
+	Server   http.Server `json:"server"`
+	ClientIP string      `json:"client_ip"`
+	ISP      string      `json:"isp"`
+
+	Latency        float64   `json:"latency_ms"`
+	Jitter         float64   `json:"jitter_ms"`
+	LatencySamples []float64 `json:"latency_samples_ms"`
+
+	Download        float64  `json:"download_mbps"`
+	Upload          float64  `json:"upload_mbps"`
+	BytesReceived   int64    `json:"bytes_received"`
+	BytesSent       int64    `json:"bytes_sent"`
+	DownloadSamples []Sample `json:"download_samples"`
+	UploadSamples   []Sample `json:"upload_samples"`
+
+	// DownloadServerID and UploadServerID are the servers the speeds were
+	// measured against, which differ from Server after a failover
+	DownloadServerID string `json:"download_server_id"`
+	UploadServerID   string `json:"upload_server_id"`
+
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Error is why a scheduled run failed, empty for a successful one
+	Error string `json:"error,omitempty"`
+}
+
+// Run selects a server the same way GetServer does, then measures its
+// latency, download and upload speed and returns everything in a Result.
+// With Failover set, either test may finish on another of the candidates.
+func (client *Client) Run(ctx context.Context, serverID string) (Result, error) {
+	result := Result{Start: time.Now()}
+
+	if config := client.HTTPClient.Config; config != nil {
+		result.ClientIP = config.IP
+		result.ISP = config.Isp
+	}
+
+	server, err := client.GetServerContext(ctx, serverID)
+	if err != nil {
+		return result, err
+	}
+
+	result.Server = server
+	result.Latency = server.Latency
+	if server.LatencyReport != nil {
+		result.Jitter = server.LatencyReport.Jitter
+		result.LatencySamples = server.LatencyReport.Samples
+	}
+
+	dl, threads, err := client.download(ctx, server)
+	if err != nil {
+		return result, err
+	}
+	result.Download = dl.speed(threads, client.HTTPClient.SpeedtestConfig.AlgoType)
+	result.BytesReceived = dl.Bytes
+	result.DownloadSamples = dl.allSamples()
+	result.DownloadServerID = dl.ServerID
+
+	ul, threads, err := client.upload(ctx, server)
+	if err != nil {
+		return result, err
+	}
+	result.Upload = ul.speed(threads, client.HTTPClient.SpeedtestConfig.AlgoType)
+	result.BytesSent = ul.Bytes
+	result.UploadSamples = ul.allSamples()
+	result.UploadServerID = ul.ServerID
+
+	result.End = time.Now()
+	return result, nil
+}
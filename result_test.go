@@ -0,0 +1,74 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sthttp "github.com/kylegrantlucas/speedtest/http"
+)
+
+func TestClient_Run(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/servers":
+			fmt.Fprintf(w, `<settings><servers><server url="%s/speedtest/upload.php" lat="32.5" lon="-90.1" name="Local" country="United States" cc="US" sponsor="Test" id="1" /></servers></settings>`, ts.URL)
+		case strings.HasSuffix(r.URL.Path, ".jpg"):
+			w.Write(make([]byte, 4096))
+		default:
+			ioutil.ReadAll(r.Body)
+			fmt.Fprintln(w, "test=test")
+		}
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		HTTPClient: &sthttp.Client{
+			SpeedtestConfig: &sthttp.SpeedtestConfig{ServersURL: ts.URL + "/servers", NumClosest: 1, NumLatencyTests: 3},
+			Config:          &sthttp.Config{IP: "127.0.0.1", Isp: "Loopback", Lat: 32.5155, Lon: -90.1118},
+			Timeout:         (15 * time.Second),
+		},
+		DLSizes: []int{350, 500},
+		ULSizes: []int{1024, 2048},
+	}
+
+	got, err := client.Run(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Client.Run() error = %v", err)
+	}
+
+	if got.Server.ID != "1" || got.ClientIP != "127.0.0.1" || got.ISP != "Loopback" {
+		t.Errorf("Client.Run() server = %v, client = %v/%v", got.Server.ID, got.ClientIP, got.ISP)
+	}
+	if len(got.LatencySamples) != 3 {
+		t.Errorf("Client.Run() latency samples = %d, want 3", len(got.LatencySamples))
+	}
+	if got.BytesReceived != 2*4096 || got.BytesSent != 1024+2048 {
+		t.Errorf("Client.Run() bytes = %d received, %d sent", got.BytesReceived, got.BytesSent)
+	}
+	if len(got.DownloadSamples) != 2 || len(got.UploadSamples) != 2 {
+		t.Errorf("Client.Run() samples = %d download, %d upload", len(got.DownloadSamples), len(got.UploadSamples))
+	}
+	if !got.End.After(got.Start) {
+		t.Errorf("Client.Run() end %v is not after start %v", got.End, got.Start)
+	}
+
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("json.Marshal(Result) error = %v", err)
+	}
+	var decoded Result
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal(Result) error = %v", err)
+	}
+	if decoded.Server.ID != got.Server.ID || decoded.BytesSent != got.BytesSent {
+		t.Errorf("Result did not survive a JSON round trip: %s", b)
+	}
+}
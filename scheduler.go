@@ -0,0 +1,93 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrInvalidInterval is returned by Scheduler.Run when Interval is not positive
+var ErrInvalidInterval = errors.New("scheduler interval must be positive")
+
+// Scheduler runs a full test every Interval and records each Result in
+// Store. Runs never overlap: when one takes longer than the interval the
+// next starts as soon as it finishes.
+type Scheduler struct {
+	Client *Client
+	// ServerID is the server to test against, the fastest nearby one when empty
+	ServerID string
+	Interval time.Duration
+	// Jitter delays each run by a random duration up to Jitter, so many
+	// schedulers started together do not test at the same moment
+	Jitter time.Duration
+
+	// Store, when set, records every run, failed ones included
+	Store HistoryStore
+	// OnResult, when set, is called after every run
+	OnResult func(Result, error)
+}
+
+// Run tests immediately, then every Interval until ctx is done, and returns
+// ctx.Err(). It returns ErrInvalidInterval without testing when Interval is
+// not positive, rather than testing back to back.
+func (s *Scheduler) Run(ctx context.Context) error {
+	if s.Interval <= 0 {
+		return ErrInvalidInterval
+	}
+
+	next := time.Now()
+
+	for {
+		if wait := time.Until(next) + s.jitter(); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		start := time.Now()
+		s.runOnce(ctx)
+
+		next = start.Add(s.Interval)
+		if next.Before(time.Now()) {
+			next = time.Now()
+		}
+	}
+}
+
+// runOnce runs a single test, records it and reports it
+func (s *Scheduler) runOnce(ctx context.Context) {
+	s.Client.logger().Debug("starting scheduled run", "server", s.ServerID)
+	result, err := s.Client.Run(ctx, s.ServerID)
+	if err != nil && ctx.Err() != nil {
+		// a run cut short by shutdown says nothing about the connection
+		return
+	}
+	if err != nil {
+		result.Error = err.Error()
+		result.End = time.Now()
+	}
+
+	if s.Store != nil {
+		if storeErr := s.Store.Append(result); storeErr != nil {
+			s.Client.logger().Error("error storing speedtest result", "error", storeErr)
+		}
+	}
+	if s.OnResult != nil {
+		s.OnResult(result, err)
+	}
+}
+
+func (s *Scheduler) jitter() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.Jitter)))
+}
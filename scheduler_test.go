@@ -0,0 +1,133 @@
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sthttp "github.com/kylegrantlucas/speedtest/http"
+)
+
+func TestScheduler_Run(t *testing.T) {
+	var running, overlaps int32
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/servers":
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.AddInt32(&overlaps, 1)
+			}
+			fmt.Fprintf(w, `<settings><servers><server url="%s/speedtest/upload.php" lat="32.5" lon="-90.1" name="Local" country="United States" cc="US" sponsor="Test" id="1" /></servers></settings>`, ts.URL)
+		case strings.HasSuffix(r.URL.Path, ".jpg"):
+			w.Write(make([]byte, 4096))
+		case strings.HasSuffix(r.URL.Path, "upload.php"):
+			ioutil.ReadAll(r.Body)
+			atomic.AddInt32(&running, -1)
+		default:
+			fmt.Fprintln(w, "test=test")
+		}
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		HTTPClient: &sthttp.Client{
+			SpeedtestConfig: &sthttp.SpeedtestConfig{ServersURL: ts.URL + "/servers", NumClosest: 1, NumLatencyTests: 1},
+			Config:          &sthttp.Config{Lat: 32.5155, Lon: -90.1118},
+			Timeout:         (15 * time.Second),
+		},
+		DLSizes: []int{350},
+		ULSizes: []int{1024},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := NewJSONLinesStore(t.TempDir() + "/history.jsonl")
+	var runs int32
+	scheduler := &Scheduler{
+		Client:   client,
+		Interval: 20 * time.Millisecond,
+		Jitter:   5 * time.Millisecond,
+		Store:    store,
+		OnResult: func(result Result, err error) {
+			if err != nil {
+				t.Errorf("scheduled run error = %v", err)
+			}
+			if atomic.AddInt32(&runs, 1) == 3 {
+				cancel()
+			}
+		},
+	}
+
+	if err := scheduler.Run(ctx); err != context.Canceled {
+		t.Errorf("Scheduler.Run() error = %v, want %v", err, context.Canceled)
+	}
+	if got := atomic.LoadInt32(&overlaps); got != 0 {
+		t.Errorf("%d scheduled runs overlapped", got)
+	}
+
+	results, err := store.Query(time.Time{}, time.Time{})
+	if err != nil || len(results) != 3 {
+		t.Fatalf("stored %d results, %v, want 3", len(results), err)
+	}
+	for i := 1; i < len(results); i++ {
+		if gap := results[i].Start.Sub(results[i-1].Start); gap < scheduler.Interval {
+			t.Errorf("runs %d and %d started %v apart, want at least %v", i-1, i, gap, scheduler.Interval)
+		}
+	}
+}
+
+func TestScheduler_RunRecordsFailures(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		HTTPClient: &sthttp.Client{
+			SpeedtestConfig: &sthttp.SpeedtestConfig{ServersURL: ts.URL, NumClosest: 1, NumLatencyTests: 1},
+			Config:          &sthttp.Config{},
+			Timeout:         (15 * time.Second),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := NewGobStore(t.TempDir() + "/history")
+	scheduler := &Scheduler{
+		Client:   client,
+		Interval: time.Hour,
+		Store:    store,
+		OnResult: func(Result, error) { cancel() },
+	}
+	scheduler.Run(ctx)
+
+	results, err := store.Query(time.Time{}, time.Time{})
+	if err != nil || len(results) != 1 || results[0].Error == "" {
+		t.Errorf("stored %+v, %v, want one failed result", results, err)
+	}
+}
+
+func TestScheduler_RunInvalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		runs := 0
+		scheduler := &Scheduler{
+			Client:   &Client{},
+			Interval: interval,
+			OnResult: func(Result, error) { runs++ },
+		}
+		if err := scheduler.Run(context.Background()); err != ErrInvalidInterval {
+			t.Errorf("Scheduler.Run() with interval %v error = %v, want %v", interval, err, ErrInvalidInterval)
+		}
+		if runs != 0 {
+			t.Errorf("Scheduler.Run() with interval %v ran %d tests, want none", interval, runs)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Package server serves the speedtest.net HTTP protocol so clients can be
+// tested against self-hosted infrastructure. It answers the config and
+// servers list requests, latency.txt, randomNxN.jpg downloads and
+// upload.php, which is everything the speedtest client uses.
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kylegrantlucas/speedtest"
+	sthttp "github.com/kylegrantlucas/speedtest/http"
+	"github.com/kylegrantlucas/speedtest/util"
+	stxml "github.com/kylegrantlucas/speedtest/xml"
+)
+
+const (
+	// ConfigPath serves the config, like speedtest-config.php
+	ConfigPath = "/speedtest-config.php"
+	// ServersPath serves the servers list, like speedtest-servers-static.php
+	ServersPath = "/speedtest-servers-static.php"
+	// TestPath is the directory latency.txt, the images and upload.php are served from
+	TestPath = "/speedtest/"
+)
+
+// DefaultMaxUploadSize caps the body accepted by upload.php when the server sets no limit
+const DefaultMaxUploadSize = 64 * 1024 * 1024
+
+var randomImage = regexp.MustCompile(`^random(\d+)x(\d+)\.jpg$`)
+
+// Server is a single self-hosted speedtest server. Its zero value serves
+// the DefaultDLSizes images with speedtest.net's usual test settings.
+type Server struct {
+	// ID, Name, Sponsor, Country, CC, Lat and Lon describe the server in the servers list
+	ID      string
+	Name    string
+	Sponsor string
+	Country string
+	CC      string
+	Lat     float64
+	Lon     float64
+
+	// URL is the base URL clients reach the server at, such as
+	// http://speedtest.example.com:8080, taken from each request when empty
+	URL string
+
+	// ISP is reported to clients in the config. Clients are placed at the
+	// server's coordinates so it is always the closest server.
+	ISP string
+
+	// ThreadCount, ThreadsPerURL, UploadThreads, UploadRatio,
+	// UploadMaxChunkSize, UploadMaxChunkCount and TestLength are the test
+	// settings advertised in the config, speedtest.net's defaults when 0
+	ThreadCount         int
+	ThreadsPerURL       int
+	UploadThreads       int
+	UploadRatio         int
+	UploadMaxChunkSize  string
+	UploadMaxChunkCount int
+	TestLength          int
+
+	// Sizes lists the randomNxN.jpg images served, DefaultDLSizes when empty
+	Sizes []int
+	// MaxUploadSize caps the body accepted by upload.php, DefaultMaxUploadSize when 0
+	MaxUploadSize int64
+
+	// Logger receives failures to write a response, http.NopLogger when nil
+	Logger speedtest.Logger
+
+	blockOnce sync.Once
+	block     []byte
+}
+
+// ServeHTTP routes the speedtest requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == ConfigPath:
+		s.serveConfig(w, r)
+	case r.URL.Path == ServersPath:
+		s.serveServers(w, r)
+	case r.URL.Path == TestPath+"latency.txt":
+		fmt.Fprintln(w, "test=test")
+	case r.URL.Path == TestPath+"upload.php":
+		s.serveUpload(w, r)
+	case strings.HasPrefix(r.URL.Path, TestPath):
+		s.serveImage(w, r, strings.TrimPrefix(r.URL.Path, TestPath))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	config := stxml.XMLConfigSettings{
+		Client: stxml.TheClient{
+			IP:  ip,
+			Lat: formatFloat(s.Lat),
+			Lon: formatFloat(s.Lon),
+			Isp: s.ISP,
+		},
+		ServerConfig: stxml.TheServerConfig{
+			ThreadCount: strconv.Itoa(or(s.ThreadCount, 4)),
+		},
+		Download: stxml.TheDownload{
+			TestLength:    strconv.Itoa(or(s.TestLength, 10)),
+			ThreadsPerURL: strconv.Itoa(or(s.ThreadsPerURL, 4)),
+		},
+		Upload: stxml.TheUpload{
+			TestLength:    strconv.Itoa(or(s.TestLength, 10)),
+			Ratio:         strconv.Itoa(or(s.UploadRatio, 5)),
+			Threads:       strconv.Itoa(or(s.UploadThreads, 2)),
+			MaxChunkSize:  s.UploadMaxChunkSize,
+			MaxChunkCount: strconv.Itoa(or(s.UploadMaxChunkCount, 50)),
+		},
+	}
+	if config.Upload.MaxChunkSize == "" {
+		config.Upload.MaxChunkSize = "512K"
+	}
+
+	s.writeXML(w, config)
+}
+
+func (s *Server) serveServers(w http.ResponseWriter, r *http.Request) {
+	base := s.URL
+	if base == "" {
+		base = "http://" + r.Host
+	}
+
+	settings := stxml.ServerSettings{
+		ServersContainer: stxml.TheServersContainer{
+			XMLServers: []stxml.XMLServer{{
+				URL:     strings.TrimSuffix(base, "/") + TestPath + "upload.php",
+				Lat:     formatFloat(s.Lat),
+				Lon:     formatFloat(s.Lon),
+				Name:    s.Name,
+				Country: s.Country,
+				CC:      s.CC,
+				Sponsor: s.Sponsor,
+				ID:      s.ID,
+			}},
+		},
+	}
+
+	s.writeXML(w, settings)
+}
+
+// serveImage streams size*size*2 pseudo-random bytes for randomNxN.jpg,
+// about the size of the images speedtest.net serves
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request, name string) {
+	match := randomImage.FindStringSubmatch(name)
+	if match == nil || match[1] != match[2] {
+		http.NotFound(w, r)
+		return
+	}
+
+	size, err := strconv.Atoi(match[1])
+	if err != nil || !s.serves(size) {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.blockOnce.Do(func() {
+		s.block = util.Urandom(1024 * 1024)
+	})
+
+	remaining := int64(size) * int64(size) * 2
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.FormatInt(remaining, 10))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for remaining > 0 {
+		chunk := s.block
+		if int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := w.Write(chunk)
+		if err != nil {
+			return
+		}
+		remaining -= int64(n)
+	}
+}
+
+// serveUpload discards the uploaded body and reports its size
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request) {
+	limit := s.MaxUploadSize
+	if limit <= 0 {
+		limit = DefaultMaxUploadSize
+	}
+
+	n, err := io.Copy(ioutil.Discard, http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	fmt.Fprintf(w, "size=%d", n)
+}
+
+// serves reports whether size is one of the image sizes served
+func (s *Server) serves(size int) bool {
+	sizes := s.Sizes
+	if len(sizes) == 0 {
+		sizes = speedtest.DefaultDLSizes
+	}
+	for _, served := range sizes {
+		if served == size {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) writeXML(w http.ResponseWriter, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if _, err := w.Write(append([]byte(xml.Header), b...)); err != nil {
+		s.logger().Warn("error writing speedtest xml", "error", err)
+	}
+}
+
+func (s *Server) logger() speedtest.Logger {
+	if s.Logger == nil {
+		return sthttp.NopLogger
+	}
+	return s.Logger
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// or returns n, or fallback when n is not set
+func or(n int, fallback int) int {
+	if n <= 0 {
+		return fallback
+	}
+	return n
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylegrantlucas/speedtest"
+	sthttp "github.com/kylegrantlucas/speedtest/http"
+)
+
+func TestServer_Client(t *testing.T) {
+	ts := httptest.NewServer(&Server{
+		ID:      "1",
+		Name:    "Lab",
+		Sponsor: "Self Hosted",
+		Country: "United States",
+		CC:      "US",
+		Lat:     32.5155,
+		Lon:     -90.1118,
+		ISP:     "Lab Network",
+	})
+	defer ts.Close()
+
+	client, err := speedtest.NewClient(&sthttp.SpeedtestConfig{
+		ConfigURL:       ts.URL + ConfigPath,
+		ServersURL:      ts.URL + ServersPath,
+		AlgoType:        "max",
+		NumClosest:      1,
+		NumLatencyTests: 2,
+	}, []int{350, 500}, []int{32 * 1024, 64 * 1024}, 15*time.Second)
+	if err != nil {
+		t.Fatalf("speedtest.NewClient() error = %v", err)
+	}
+
+	config := client.HTTPClient.Config
+	if config.Isp != "Lab Network" || config.IP != "127.0.0.1" || config.ThreadCount != 4 || config.UploadMaxChunkSize != 512*1024 {
+		t.Errorf("config = %+v", config)
+	}
+
+	server, err := client.GetServer("")
+	if err != nil {
+		t.Fatalf("Client.GetServer() error = %v", err)
+	}
+	if server.ID != "1" || server.Sponsor != "Self Hosted" || server.Distance != 0 {
+		t.Errorf("Client.GetServer() = %+v", server)
+	}
+
+	if dl, err := client.Download(server); err != nil || dl <= 0 {
+		t.Errorf("Client.Download() = %v, %v", dl, err)
+	}
+	if ul, err := client.Upload(server); err != nil || ul <= 0 {
+		t.Errorf("Client.Upload() = %v, %v", ul, err)
+	}
+}
+
+func TestServer_ServeHTTP(t *testing.T) {
+	ts := httptest.NewServer(&Server{Sizes: []int{350}, MaxUploadSize: 1024})
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantLen    int
+	}{
+		{name: "latency", method: "GET", path: "/speedtest/latency.txt", wantStatus: 200, wantLen: len("test=test\n")},
+		{name: "served image", method: "GET", path: "/speedtest/random350x350.jpg", wantStatus: 200, wantLen: 350 * 350 * 2},
+		{name: "unserved image", method: "GET", path: "/speedtest/random500x500.jpg", wantStatus: 404},
+		{name: "upload", method: "POST", path: "/speedtest/upload.php", body: "content1=abc", wantStatus: 200, wantLen: len("size=12")},
+		{name: "upload too large", method: "POST", path: "/speedtest/upload.php", body: strings.Repeat("a", 2048), wantStatus: 413},
+		{name: "unknown", method: "GET", path: "/elsewhere", wantStatus: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantLen > 0 && len(b) != tt.wantLen {
+				t.Errorf("%s %s body is %d bytes, want %d", tt.method, tt.path, len(b), tt.wantLen)
+			}
+		})
+	}
+}
+
+// failingWriter is a ResponseWriter whose body writes all fail
+type failingWriter struct {
+	httptest.ResponseRecorder
+}
+
+func (w *failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// warnings records the messages of Warn events
+type warnings []string
+
+func (l *warnings) Debug(string, ...interface{})         {}
+func (l *warnings) Info(string, ...interface{})          {}
+func (l *warnings) Warn(msg string, args ...interface{}) { *l = append(*l, msg) }
+func (l *warnings) Error(string, ...interface{})         {}
+
+func TestServer_Logger(t *testing.T) {
+	logger := &warnings{}
+	s := &Server{Logger: logger}
+
+	w := &failingWriter{*httptest.NewRecorder()}
+	s.ServeHTTP(w, httptest.NewRequest("GET", ConfigPath, nil))
+
+	if len(*logger) != 1 || (*logger)[0] != "error writing speedtest xml" {
+		t.Errorf("logged %v, want the failed config write", *logger)
+	}
+}
@@ -0,0 +1,271 @@
+package speedtest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// PhaseDownload names the download test in progress reports
+	PhaseDownload = "download"
+	// PhaseUpload names the upload test in progress reports
+	PhaseUpload = "upload"
+)
+
+// DefaultProgressInterval is how often progress is reported when the client sets no interval
+var DefaultProgressInterval = 500 * time.Millisecond
+
+// Sample is a single request measured during a download or upload test
+type Sample struct {
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+	Mbps     float64       `json:"mbps"`
+	// ServerID is the server the request was made to
+	ServerID string `json:"server_id,omitempty"`
+}
+
+// Progress is a snapshot of a running download or upload test
+type Progress struct {
+	Phase   string
+	Bytes   int64
+	Elapsed time.Duration
+	// Mbps is the throughput since the previous report
+	Mbps float64
+}
+
+// transfer is the outcome of running a set of download or upload requests
+type transfer struct {
+	Bytes   int64
+	Elapsed time.Duration
+	Samples []Sample
+	Bounded bool
+
+	// ServerID is the server the transfer ran against
+	ServerID string
+	// Earlier holds the samples of attempts against servers failed over from
+	Earlier []Sample
+}
+
+// tag records that the transfer ran against the server with id
+func (t *transfer) tag(id string) {
+	t.ServerID = id
+	for i := range t.Samples {
+		t.Samples[i].ServerID = id
+	}
+}
+
+// allSamples returns the samples of every attempt, failed over ones first
+func (t transfer) allSamples() []Sample {
+	if len(t.Earlier) == 0 {
+		return t.Samples
+	}
+	return append(append([]Sample(nil), t.Earlier...), t.Samples...)
+}
+
+// transferOptions controls how runTransfer issues its jobs
+type transferOptions struct {
+	// Threads is the number of concurrent workers
+	Threads int
+	// Length bounds the test by duration when non-zero
+	Length time.Duration
+
+	Phase    string
+	Progress func(Progress)
+	Interval time.Duration
+}
+
+// job performs a single request, passing the bytes it moves through m,
+// and returns the number of bytes it moved
+type job func(ctx context.Context, m *meter) (int64, error)
+
+// meter counts the bytes moved by every job of a transfer as they stream
+type meter struct {
+	n int64
+}
+
+// Write counts p, letting a meter be the destination of a download or the
+// progress of an upload
+func (m *meter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&m.n, int64(len(p)))
+	return len(p), nil
+}
+
+func (m *meter) total() int64 {
+	return atomic.LoadInt64(&m.n)
+}
+
+// mbps converts a byte count over a duration to megabits per second
+func mbps(bytes int64, d time.Duration) float64 {
+	seconds := d.Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+
+	megabits := float64(bytes*8) / float64(1000) / float64(1000)
+	return megabits / seconds
+}
+
+// runTransfer runs jobs across opts.Threads workers and measures them over
+// a shared wall-clock window. The first failing job cancels the rest. When
+// opts.Length is non-zero the jobs are issued over and over until it
+// elapses, and requests still in flight at that point count their partial
+// bytes.
+func runTransfer(ctx context.Context, jobs []job, opts transferOptions) (transfer, error) {
+	var result transfer
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	threads := opts.Threads
+	if threads < 1 {
+		threads = 1
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	if opts.Length > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, opts.Length)
+		result.Bounded = true
+	}
+	defer cancel()
+
+	m := &meter{}
+	queue := make(chan job)
+	start := time.Now()
+
+	stopProgress := reportProgress(m, start, opts)
+
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				if runCtx.Err() != nil {
+					continue
+				}
+
+				jobStart := time.Now()
+				n, err := j(runCtx, m)
+				d := time.Since(jobStart)
+
+				// the test length running out is how a bounded test ends
+				if err != nil && result.Bounded && ctx.Err() == nil && runCtx.Err() == context.DeadlineExceeded {
+					err = nil
+				}
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				} else {
+					result.Bytes += n
+					result.Samples = append(result.Samples, Sample{Bytes: n, Duration: d, Mbps: mbps(n, d)})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < len(jobs) || (result.Bounded && len(jobs) > 0); i++ {
+		select {
+		case queue <- jobs[i%len(jobs)]:
+		case <-runCtx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+	stopProgress()
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	return result, firstErr
+}
+
+// reportProgress calls opts.Progress every opts.Interval with the bytes
+// counted by m until the returned stop function is called, which sends a
+// final report and waits for the reporter to exit. Progress is never
+// called concurrently with itself.
+func reportProgress(m *meter, start time.Time, opts transferOptions) (stop func()) {
+	if opts.Progress == nil {
+		return func() {}
+	}
+
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var lastBytes int64
+		lastTime := start
+		report := func(now time.Time) {
+			bytes := m.total()
+			opts.Progress(Progress{
+				Phase:   opts.Phase,
+				Bytes:   bytes,
+				Elapsed: now.Sub(start),
+				Mbps:    mbps(bytes-lastBytes, now.Sub(lastTime)),
+			})
+			lastBytes = bytes
+			lastTime = now
+		}
+
+		for {
+			select {
+			case now := <-ticker.C:
+				report(now)
+			case <-done:
+				report(time.Now())
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// speed reduces a transfer to a single Mbps figure. A single-threaded
+// transfer keeps the per-request "max" or average semantics of algoType,
+// while a concurrent or bounded one reports aggregate throughput over the
+// window.
+func (t transfer) speed(threads int, algoType string) float64 {
+	if threads > 1 || t.Bounded {
+		return mbps(t.Bytes, t.Elapsed)
+	}
+
+	var maxSpeed float64
+	var avgSpeed float64
+	for _, s := range t.Samples {
+		if s.Mbps > maxSpeed {
+			maxSpeed = s.Mbps
+		}
+		avgSpeed = avgSpeed + s.Mbps
+	}
+
+	if algoType == max {
+		return maxSpeed
+	}
+	if len(t.Samples) == 0 {
+		return 0
+	}
+	return avgSpeed / float64(len(t.Samples))
+}
@@ -0,0 +1,123 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMbps(t *testing.T) {
+	tests := []struct {
+		name  string
+		bytes int64
+		d     time.Duration
+		want  float64
+	}{
+		{name: "one megabit per second", bytes: 125000, d: time.Second, want: 1},
+		{name: "zero duration", bytes: 125000, d: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mbps(tt.bytes, tt.d); got != tt.want {
+				t.Errorf("mbps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunTransfer(t *testing.T) {
+	ok := func(ctx context.Context, m *meter) (int64, error) { return 1000, nil }
+	fail := func(ctx context.Context, m *meter) (int64, error) { return 0, errors.New("planned failure") }
+
+	tests := []struct {
+		name      string
+		jobs      []job
+		threads   int
+		wantBytes int64
+		wantErr   bool
+	}{
+		{name: "sequential", jobs: []job{ok, ok, ok}, threads: 1, wantBytes: 3000},
+		{name: "concurrent", jobs: []job{ok, ok, ok, ok}, threads: 3, wantBytes: 4000},
+		{name: "failure", jobs: []job{ok, fail, ok}, threads: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runTransfer(context.Background(), tt.jobs, transferOptions{Threads: tt.threads})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runTransfer() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && got.Bytes != tt.wantBytes {
+				t.Errorf("runTransfer() bytes = %v, want %v", got.Bytes, tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestRunTransferBounded(t *testing.T) {
+	// the first requests finish quickly and every later one only ends when
+	// the test length runs out, so both workers are always mid-request then
+	var calls int32
+	slow := func(ctx context.Context, m *meter) (int64, error) {
+		if atomic.AddInt32(&calls, 1) <= 4 {
+			time.Sleep(5 * time.Millisecond)
+			return 1000, nil
+		}
+		<-ctx.Done()
+		return 500, ctx.Err()
+	}
+
+	got, err := runTransfer(context.Background(), []job{slow}, transferOptions{Threads: 2, Length: 110 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("runTransfer() error = %v", err)
+	}
+	if !got.Bounded {
+		t.Errorf("runTransfer() bounded = false, want true")
+	}
+	if got.Elapsed < 110*time.Millisecond || got.Elapsed > time.Second {
+		t.Errorf("runTransfer() elapsed = %v, want about 110ms", got.Elapsed)
+	}
+	// both workers finish several requests before being cut short mid-request
+	if got.Bytes != 4*1000+2*500 {
+		t.Errorf("runTransfer() bytes = %v, want four whole requests plus two partial ones", got.Bytes)
+	}
+}
+
+func TestRunTransferProgress(t *testing.T) {
+	chunked := func(ctx context.Context, m *meter) (int64, error) {
+		for i := 0; i < 5; i++ {
+			time.Sleep(10 * time.Millisecond)
+			m.Write(make([]byte, 100))
+		}
+		return 500, nil
+	}
+
+	var reports []Progress
+	opts := transferOptions{
+		Threads:  2,
+		Phase:    PhaseDownload,
+		Progress: func(p Progress) { reports = append(reports, p) },
+		Interval: 15 * time.Millisecond,
+	}
+
+	if _, err := runTransfer(context.Background(), []job{chunked, chunked, chunked, chunked}, opts); err != nil {
+		t.Fatalf("runTransfer() error = %v", err)
+	}
+	if len(reports) < 2 {
+		t.Fatalf("runTransfer() sent %d progress reports, want several", len(reports))
+	}
+
+	for i, p := range reports {
+		if p.Phase != PhaseDownload {
+			t.Errorf("report %d phase = %q, want %q", i, p.Phase, PhaseDownload)
+		}
+		if i > 0 && p.Bytes < reports[i-1].Bytes {
+			t.Errorf("report %d bytes = %d, went backwards from %d", i, p.Bytes, reports[i-1].Bytes)
+		}
+	}
+	if last := reports[len(reports)-1]; last.Bytes != 2000 {
+		t.Errorf("final report bytes = %d, want 2000", last.Bytes)
+	}
+}
@@ -12,10 +12,34 @@ type TheClient struct {
 	Isp string `xml:"isp,attr"`
 }
 
+// TheServerConfig is the server selection part of the settings
+type TheServerConfig struct {
+	ThreadCount string `xml:"threadcount,attr"`
+	IgnoreIDs   string `xml:"ignoreids,attr"`
+}
+
+// TheDownload is the download test part of the settings
+type TheDownload struct {
+	TestLength    string `xml:"testlength,attr"`
+	ThreadsPerURL string `xml:"threadsperurl,attr"`
+}
+
+// TheUpload is the upload test part of the settings
+type TheUpload struct {
+	TestLength    string `xml:"testlength,attr"`
+	Ratio         string `xml:"ratio,attr"`
+	Threads       string `xml:"threads,attr"`
+	MaxChunkSize  string `xml:"maxchunksize,attr"`
+	MaxChunkCount string `xml:"maxchunkcount,attr"`
+}
+
 // XMLConfigSettings is a container for settings
 type XMLConfigSettings struct {
-	XMLName xml.Name  `xml:"settings"`
-	Client  TheClient `xml:"client"`
+	XMLName      xml.Name        `xml:"settings"`
+	Client       TheClient       `xml:"client"`
+	ServerConfig TheServerConfig `xml:"server-config"`
+	Download     TheDownload     `xml:"download"`
+	Upload       TheUpload       `xml:"upload"`
 }
 
 // XMLServer is a candidate server